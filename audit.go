@@ -0,0 +1,68 @@
+package go_watch
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+type AuditEvent struct {
+	Session int
+	Export  string // export that performed the write or call
+	Type    string // go type of the modified struct/map/slice/value, or the function type
+	Path    string // field name, map key or slice index
+	Old     string // %#v of the old value
+	New     string // %#v of the new value, or the call arguments
+	Func    string // called function name
+}
+
+type AuditFunc func(event *AuditEvent)
+
+// WithAudit reports every write and function call performed by scripts
+func WithAudit(audit AuditFunc) Option {
+	return func(ctx *Context) {
+		ctx.audit = audit
+	}
+}
+
+func formatValue(v reflect.Value) string {
+	if !v.IsValid() {
+		return "<nil>"
+	}
+	// fmt walks reflect.Value without Interface, so unexported fields are readable
+	return fmt.Sprintf("%#v", v)
+}
+
+func formatArgs(args []reflect.Value) string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		out[i] = formatValue(arg)
+	}
+	return "(" + strings.Join(out, ", ") + ")"
+}
+
+func typeString(t reflect.Type) string {
+	if t == nil {
+		return "<nil>"
+	}
+	return t.String()
+}
+
+// auditWrite records old before the write, the returned func reports the event with the new value
+func (ctx *Context) auditWrite(export string, typ reflect.Type, path string, old reflect.Value) func(newVal reflect.Value) {
+	if ctx.audit == nil {
+		return func(reflect.Value) {}
+	}
+	event := &AuditEvent{Session: ctx.session, Export: export, Type: typeString(typ), Path: path, Old: formatValue(old)}
+	return func(newVal reflect.Value) {
+		event.New = formatValue(newVal)
+		ctx.audit(event)
+	}
+}
+
+func (ctx *Context) auditCall(export string, name string, typ reflect.Type, args []reflect.Value) {
+	if ctx.audit == nil {
+		return
+	}
+	ctx.audit(&AuditEvent{Session: ctx.session, Export: export, Type: typeString(typ), New: formatArgs(args), Func: name})
+}
@@ -0,0 +1,66 @@
+package go_watch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []AuditEvent // Session is always 1
+	}{
+		{
+			name:   "set_number",
+			script: `go_watch.set_number(role.ID, 8)`,
+			want:   []AuditEvent{{Export: "set_number", Type: "int", Old: "7", New: "8"}},
+		},
+		{
+			name:   "set by metatable",
+			script: `role.Name = "b"`,
+			want:   []AuditEvent{{Export: "set_path", Type: "go_watch.testRole", Path: "Name", Old: `"a"`, New: `"b"`}},
+		},
+		{
+			name:   "map_set",
+			script: `go_watch.map_set(role.Attrs, go_watch.new_string("hp"), go_watch.new_int(1))`,
+			want:   []AuditEvent{{Export: "map_set", Type: "map[string]int", Path: `"hp"`, Old: "<nil>", New: "1"}},
+		},
+		{
+			name:   "call",
+			script: `role.SetName("c")`,
+			want:   []AuditEvent{{Export: "call", Type: "func(string)", New: `("c")`, Func: "github.com/lsg2020/go-watch.(*testRole).SetName"}},
+		},
+		{
+			name:   "slice_append into spare capacity",
+			script: `go_watch.slice_append(go_watch.array_slice(role.Items, 0, 1), go_watch.new_int(9))`,
+			want:   []AuditEvent{{Export: "slice_append", Type: "[]int", Path: "[1]", Old: "2", New: "9"}},
+		},
+		{
+			name:   "slice_append to a new array",
+			script: `go_watch.slice_append(role.Items, go_watch.new_int(9))`,
+		},
+		{
+			name:   "reads",
+			script: `assert(go_watch.get_number(role.ID) == 7 and #role.Items == 3)`,
+		},
+	}
+
+	for _, tt := range tests {
+		role := &testRole{ID: 7, Name: "a", Items: []int{1, 2, 3}, Attrs: map[string]int{}}
+		var events []AuditEvent
+		state, _ := newTestState(t, role, WithAudit(func(event *AuditEvent) {
+			events = append(events, *event)
+		}))
+		if err := Execute(state, testScript(tt.script), 1); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		for i := range tt.want {
+			tt.want[i].Session = 1
+		}
+		if len(events) != len(tt.want) || (len(events) > 0 && !reflect.DeepEqual(events, tt.want)) {
+			t.Errorf("%s: events = %+v, want %+v", tt.name, events, tt.want)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const scriptPrefix = "local go_watch = require('go_watch'); "
+
+type message struct {
+	Session string `json:"session"`
+	Type    string `json:"type"`
+	Data    string `json:"data"`
+	Line    int    `json:"line"`
+}
+
+// scriptError shows the failing line of the script
+type scriptError struct {
+	msg    string
+	line   int
+	source string
+}
+
+func (e *scriptError) Error() string {
+	lines := strings.Split(e.source, "\n")
+	if e.line <= 0 || e.line > len(lines) {
+		return e.msg
+	}
+	return fmt.Sprintf("%s\n%4d | %s", e.msg, e.line, strings.TrimPrefix(lines[e.line-1], scriptPrefix))
+}
+
+// client runs the scripts in one session, opened by the server on the first script
+type client struct {
+	addr    string
+	session string
+	http    *http.Client
+}
+
+func (c *client) execute(script string) error {
+	u, err := url.Parse(c.addr)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("format", "ndjson")
+	if c.session != "" {
+		q.Set("session", c.session)
+	} else {
+		q.Set("session", "new")
+	}
+	u.RawQuery = q.Encode()
+
+	rsp, err := c.http.Post(u.String(), "text/plain", strings.NewReader(scriptPrefix+script))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if session := rsp.Header.Get("X-Go-Watch-Session"); session != "" {
+		c.session = session
+	}
+
+	// script errors are sent as ndjson with an error status
+	if rsp.StatusCode != http.StatusOK && !strings.HasPrefix(rsp.Header.Get("Content-Type"), "application/x-ndjson") {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return fmt.Errorf("%s: %s", rsp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var scriptErr error
+	decoder := json.NewDecoder(rsp.Body)
+	for {
+		var msg message
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return scriptErr
+			}
+			return err
+		}
+		if msg.Type == "print" {
+			fmt.Println(msg.Data)
+		} else {
+			scriptErr = &scriptError{msg: msg.Data, line: msg.Line, source: scriptPrefix + script}
+		}
+	}
+}
+
+type repl struct {
+	client      *client
+	history     []string
+	historyFile string
+}
+
+func (r *repl) loadHistory() {
+	data, err := ioutil.ReadFile(r.historyFile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\x00") {
+		if line != "" {
+			r.history = append(r.history, line)
+		}
+	}
+}
+
+func (r *repl) addHistory(script string) {
+	r.history = append(r.history, script)
+	if r.historyFile == "" {
+		return
+	}
+	f, err := os.OpenFile(r.historyFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.WriteString(script + "\x00")
+}
+
+func (r *repl) run(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var lines []string
+	for {
+		if len(lines) == 0 {
+			fmt.Print("go_watch> ")
+		} else {
+			fmt.Print(">> ")
+		}
+		if !scanner.Scan() {
+			fmt.Println()
+			return
+		}
+		line := scanner.Text()
+
+		if len(lines) == 0 {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" {
+				continue
+			}
+			if strings.HasPrefix(trimmed, ":") || strings.HasPrefix(trimmed, "!") {
+				if quit := r.command(trimmed); quit {
+					return
+				}
+				continue
+			}
+		}
+
+		lines = append(lines, line)
+		script := strings.Join(lines, "\n")
+		if incomplete(script) {
+			continue
+		}
+		lines = nil
+
+		r.addHistory(script)
+		r.execute(sessionGlobals(script))
+	}
+}
+
+var localRegexp = regexp.MustCompile(`\blocal\s+`)
+
+// sessionGlobals turns the top level `local x = ...` and `local function f` of an input into globals,
+// the server keeps globals of a session, so later inputs still see them. `local x` without value stays local
+func sessionGlobals(script string) string {
+	chunk, err := parse.Parse(strings.NewReader(script), "repl")
+	if err != nil {
+		return script
+	}
+	locals := make(map[int]int)
+	for _, stmt := range chunk {
+		if assign, ok := stmt.(*ast.LocalAssignStmt); ok && len(assign.Exprs) > 0 {
+			locals[stmt.Line()]++
+		}
+	}
+	if len(locals) == 0 {
+		return script
+	}
+
+	lines := strings.Split(script, "\n")
+	for line, n := range locals {
+		if line <= 0 || line > len(lines) {
+			continue
+		}
+		lines[line-1] = localRegexp.ReplaceAllStringFunc(lines[line-1], func(local string) string {
+			if n <= 0 {
+				return local
+			}
+			n--
+			return ""
+		})
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r *repl) execute(script string) {
+	if err := r.client.execute(script); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+	}
+}
+
+func (r *repl) command(cmd string) bool {
+	fields := strings.Fields(cmd)
+	switch {
+	case fields[0] == ":quit" || fields[0] == ":q":
+		return true
+	case fields[0] == ":help":
+		fmt.Println(`:load <file.lua>   execute a lua file
+:session [id|new]  show, switch or open a new session
+:history           list history
+!<n>               execute history entry n
+:quit              exit
+top level locals of an input are kept as globals of the session until it is idle on the server,
+go_watch is required automatically`)
+	case fields[0] == ":load":
+		if len(fields) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: :load <file.lua>")
+			return false
+		}
+		data, err := ioutil.ReadFile(fields[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return false
+		}
+		r.execute(string(data))
+	case fields[0] == ":session":
+		if len(fields) != 2 {
+			fmt.Println(r.client.session)
+			return false
+		}
+		if fields[1] == "new" {
+			// the server opens it with the next script
+			r.client.session = ""
+		} else {
+			r.client.session = fields[1]
+		}
+	case fields[0] == ":history":
+		for i, script := range r.history {
+			fmt.Printf("%4d  %s\n", i+1, strings.ReplaceAll(script, "\n", "\n      "))
+		}
+	case strings.HasPrefix(fields[0], "!"):
+		i, err := strconv.Atoi(fields[0][1:])
+		if err != nil || i <= 0 || i > len(r.history) {
+			fmt.Fprintf(os.Stderr, "history:%s not found\n", fields[0][1:])
+			return false
+		}
+		script := r.history[i-1]
+		fmt.Println(script)
+		r.addHistory(script)
+		r.execute(script)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command:%s, try :help\n", fields[0])
+	}
+	return false
+}
+
+func incomplete(script string) bool {
+	_, err := parse.Parse(strings.NewReader(script), "repl")
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "at EOF:") && !strings.Contains(msg, "unterminated string")
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".go_watch_history")
+}
+
+func main() {
+	addr := flag.String("addr", "http://127.0.0.1:8080/debug/go_watch", "go_watch http endpoint")
+	session := flag.String("session", "", "session id returned by the server, a new session when empty")
+	script := flag.String("e", "", "execute script and exit")
+	historyFile := flag.String("history", defaultHistoryFile(), "history file, empty to disable")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [file.lua ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	c := &client{addr: *addr, session: *session, http: http.DefaultClient}
+
+	if *script != "" || flag.NArg() > 0 {
+		var err error
+		if *script != "" {
+			err = c.execute(*script)
+		}
+		for _, file := range flag.Args() {
+			if err != nil {
+				break
+			}
+			var data []byte
+			if data, err = ioutil.ReadFile(file); err == nil {
+				err = c.execute(string(data))
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	r := &repl{client: c, historyFile: *historyFile}
+	if r.historyFile != "" {
+		r.loadHistory()
+	}
+	r.run(os.Stdin)
+}
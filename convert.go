@@ -0,0 +1,547 @@
+package go_watch
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const defaultToLuaDepth = 8
+
+// luaToValue converts a lua value to a go value of type t, userdata is used as is when assignable
+func luaToValue(lv lua.LValue, t reflect.Type) (reflect.Value, error) {
+	return convertLua(lv, t, nil)
+}
+
+func convertLua(lv lua.LValue, t reflect.Type, visiting map[*lua.LTable]bool) (reflect.Value, error) {
+	if ud, ok := lv.(*lua.LUserData); ok {
+		v := userDataValue(ud)
+		if !v.IsValid() {
+			return reflect.Zero(t), nil
+		}
+		if v.Type().AssignableTo(t) {
+			return v, nil
+		}
+		if convertibleKind(v.Kind(), t.Kind()) {
+			if numberOverflow(v, t) {
+				return reflect.Value{}, fmt.Errorf("%s overflow %s", formatValue(v), t)
+			}
+			return v.Convert(t), nil
+		}
+		return reflect.Value{}, fmt.Errorf("type mismatch %s need %s", v.Type(), t)
+	}
+
+	v := reflect.New(t).Elem()
+	if lv == lua.LNil {
+		return v, nil
+	}
+	if tb, ok := lv.(*lua.LTable); ok && t.Kind() != reflect.Ptr && t.Kind() != reflect.Interface {
+		if visiting[tb] {
+			return reflect.Value{}, fmt.Errorf("table cycle detected converting to %s", t)
+		}
+		if visiting == nil {
+			visiting = make(map[*lua.LTable]bool)
+		}
+		visiting[tb] = true
+		defer delete(visiting, tb)
+		return v, tableToValue(tb, v, visiting)
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		b, ok := lv.(lua.LBool)
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("%s need boolean", lv.Type())
+		}
+		v.SetBool(bool(b))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch n := lv.(type) {
+		case lua.LNumber:
+			v.SetInt(int64(n))
+		case lua.LString:
+			i, err := strconv.ParseInt(string(n), 10, 64)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("parse int error:%s", err.Error())
+			}
+			v.SetInt(i)
+		default:
+			return reflect.Value{}, fmt.Errorf("%s need number/string", lv.Type())
+		}
+		if v.OverflowInt(v.Int()) {
+			return reflect.Value{}, fmt.Errorf("%s overflow %s", lv.String(), t)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		switch n := lv.(type) {
+		case lua.LNumber:
+			v.SetUint(uint64(n))
+		case lua.LString:
+			i, err := strconv.ParseUint(string(n), 10, 64)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("parse uint error:%s", err.Error())
+			}
+			v.SetUint(i)
+		default:
+			return reflect.Value{}, fmt.Errorf("%s need number/string", lv.Type())
+		}
+		if v.OverflowUint(v.Uint()) {
+			return reflect.Value{}, fmt.Errorf("%s overflow %s", lv.String(), t)
+		}
+	case reflect.Float32, reflect.Float64:
+		switch n := lv.(type) {
+		case lua.LNumber:
+			v.SetFloat(float64(n))
+		case lua.LString:
+			f, err := strconv.ParseFloat(string(n), 64)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("parse float error:%s", err.Error())
+			}
+			v.SetFloat(f)
+		default:
+			return reflect.Value{}, fmt.Errorf("%s need number/string", lv.Type())
+		}
+	case reflect.String:
+		switch n := lv.(type) {
+		case lua.LString:
+			v.SetString(string(n))
+		case lua.LNumber:
+			v.SetString(n.String())
+		default:
+			return reflect.Value{}, fmt.Errorf("%s need string", lv.Type())
+		}
+	case reflect.Ptr:
+		elem, err := convertLua(lv, t.Elem(), visiting)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v = reflect.New(t.Elem())
+		v.Elem().Set(elem)
+	case reflect.Interface:
+		i := luaToInterface(lv)
+		if i == nil {
+			return reflect.Value{}, fmt.Errorf("%s can not convert to %s", lv.Type(), t)
+		}
+		if !reflect.TypeOf(i).AssignableTo(t) {
+			return reflect.Value{}, fmt.Errorf("%T not implements %s", i, t)
+		}
+		v.Set(reflect.ValueOf(i))
+	default:
+		return reflect.Value{}, fmt.Errorf("%s can not convert to %s", lv.Type(), t)
+	}
+	return v, nil
+}
+
+// luaArgs converts call arguments to the parameter types of ftyp, userdata is passed as is when ftyp is unknown
+func luaArgs(args []lua.LValue, ftyp reflect.Type) ([]reflect.Value, error) {
+	values := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		t := argType(ftyp, i)
+		if t == nil {
+			ud, ok := arg.(*lua.LUserData)
+			if !ok {
+				if ftyp != nil {
+					return nil, fmt.Errorf("in params:%d too many, need %d", i+1, ftyp.NumIn())
+				}
+				return nil, fmt.Errorf("in params:%d not user data", i+1)
+			}
+			values[i] = userDataValue(ud)
+			continue
+		}
+		v, err := luaToValue(arg, t)
+		if err != nil {
+			return nil, fmt.Errorf("in params:%d %s", i+1, err.Error())
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func tableArgs(tb *lua.LTable) []lua.LValue {
+	args := make([]lua.LValue, tb.Len())
+	for i := range args {
+		args[i] = tb.RawGetInt(i + 1)
+	}
+	return args
+}
+
+// detectVariadic treats a trailing slice parameter as variadic unless the last argument already is that slice.
+// dwarf does not mark variadic functions, so `func(xs []int)` called with loose ints is variadic too
+func detectVariadic(ftyp reflect.Type, args []lua.LValue) bool {
+	if ftyp == nil || ftyp.NumIn() == 0 {
+		return false
+	}
+	n := ftyp.NumIn()
+	last := ftyp.In(n - 1)
+	if last.Kind() != reflect.Slice {
+		return false
+	}
+	if len(args) != n {
+		return true
+	}
+	switch arg := args[n-1].(type) {
+	case *lua.LTable:
+		return false
+	case *lua.LUserData:
+		return !assignableTo(arg, last)
+	default:
+		return arg != lua.LNil
+	}
+}
+
+func variadicFuncOf(ftyp reflect.Type) reflect.Type {
+	in := make([]reflect.Type, ftyp.NumIn())
+	for i := range in {
+		in[i] = ftyp.In(i)
+	}
+	out := make([]reflect.Type, ftyp.NumOut())
+	for i := range out {
+		out[i] = ftyp.Out(i)
+	}
+	return reflect.FuncOf(in, out, true)
+}
+
+func argType(ftyp reflect.Type, i int) reflect.Type {
+	if ftyp == nil {
+		return nil
+	}
+	n := ftyp.NumIn()
+	if ftyp.IsVariadic() && i >= n-1 {
+		return ftyp.In(n - 1).Elem()
+	}
+	if i < n {
+		return ftyp.In(i)
+	}
+	return nil
+}
+
+func assignableTo(lv lua.LValue, t reflect.Type) bool {
+	ud, ok := lv.(*lua.LUserData)
+	if !ok {
+		return false
+	}
+	v := userDataValue(ud)
+	return v.IsValid() && v.Type().AssignableTo(t)
+}
+
+func isNumberKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// numberOverflow reports whether the number v does not fit in t, Convert would silently truncate it.
+// fractions of floats converted to integers are dropped like for lua numbers
+func numberOverflow(v reflect.Value, t reflect.Type) bool {
+	to := reflect.New(t).Elem()
+	switch {
+	case isIntKind(t.Kind()):
+		switch {
+		case isIntKind(v.Kind()):
+			return to.OverflowInt(v.Int())
+		case isUintKind(v.Kind()):
+			return v.Uint() > math.MaxInt64 || to.OverflowInt(int64(v.Uint()))
+		case isFloatKind(v.Kind()):
+			f := v.Float()
+			return !(f >= -1<<63 && f < 1<<63) || to.OverflowInt(int64(f))
+		}
+	case isUintKind(t.Kind()):
+		switch {
+		case isIntKind(v.Kind()):
+			return v.Int() < 0 || to.OverflowUint(uint64(v.Int()))
+		case isUintKind(v.Kind()):
+			return to.OverflowUint(v.Uint())
+		case isFloatKind(v.Kind()):
+			f := v.Float()
+			return !(f > -1 && f < 1<<64) || to.OverflowUint(uint64(f))
+		}
+	case isFloatKind(t.Kind()) && isFloatKind(v.Kind()):
+		f := v.Float()
+		return !math.IsInf(f, 0) && !math.IsNaN(f) && to.OverflowFloat(f)
+	}
+	return false
+}
+
+func isIntKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUintKind(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
+
+func isFloatKind(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+// convertibleKind allows new_int(1) for an int32 field or a string for a named string type
+func convertibleKind(from reflect.Kind, to reflect.Kind) bool {
+	if isNumberKind(from) && isNumberKind(to) {
+		return true
+	}
+	return from == to && (from == reflect.Bool || from == reflect.String)
+}
+
+func tableToValue(tb *lua.LTable, v reflect.Value, visiting map[*lua.LTable]bool) error {
+	t := v.Type()
+	var err error
+	switch t.Kind() {
+	case reflect.Struct:
+		tb.ForEach(func(k lua.LValue, lv lua.LValue) {
+			if err != nil {
+				return
+			}
+			name, ok := k.(lua.LString)
+			if !ok {
+				err = fmt.Errorf("%s field name need string, got %s", t, k.Type())
+				return
+			}
+			var rf, rv reflect.Value
+			if rf, err = fieldByName(v, string(name)); err != nil {
+				return
+			}
+			if rv, err = convertLua(lv, rf.Type(), visiting); err != nil {
+				err = fmt.Errorf("%s.%s: %s", t, name, err.Error())
+				return
+			}
+			rf.Set(rv)
+		})
+	case reflect.Map:
+		v.Set(reflect.MakeMap(t))
+		tb.ForEach(func(k lua.LValue, lv lua.LValue) {
+			if err != nil {
+				return
+			}
+			var rk, rv reflect.Value
+			if rk, err = convertLua(k, t.Key(), visiting); err != nil {
+				return
+			}
+			if rv, err = convertLua(lv, t.Elem(), visiting); err != nil {
+				err = fmt.Errorf("%s[%s]: %s", t, k.String(), err.Error())
+				return
+			}
+			v.SetMapIndex(rk, rv)
+		})
+	case reflect.Slice, reflect.Array:
+		n := tb.Len()
+		if t.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(t, n, n))
+		} else if n > t.Len() {
+			return fmt.Errorf("%s len %d less than table len %d", t, t.Len(), n)
+		}
+		for i := 0; i < n; i++ {
+			rv, err := convertLua(tb.RawGetInt(i+1), t.Elem(), visiting)
+			if err != nil {
+				return fmt.Errorf("%s[%d]: %s", t, i, err.Error())
+			}
+			v.Index(i).Set(rv)
+		}
+	default:
+		return fmt.Errorf("table can not convert to %s", t)
+	}
+	return err
+}
+
+// luaToInterface converts lua values to plain go values, array like tables become []interface{}
+func luaToInterface(lv lua.LValue) interface{} {
+	return tableToInterface(lv, nil, nil)
+}
+
+// tableToInterface converts userdata that can not Interface, e.g. read from unexported fields, with opaque, nil if opaque is nil
+func tableToInterface(lv lua.LValue, visiting map[*lua.LTable]bool, opaque func(v reflect.Value) interface{}) interface{} {
+	switch n := lv.(type) {
+	case lua.LBool:
+		return bool(n)
+	case lua.LNumber:
+		return float64(n)
+	case lua.LString:
+		return string(n)
+	case *lua.LUserData:
+		v := userDataValue(n)
+		if v.IsValid() && v.CanInterface() {
+			return v.Interface()
+		}
+		if v.IsValid() && opaque != nil {
+			return opaque(v)
+		}
+		return nil
+	case *lua.LTable:
+		// cycles are cut to nil
+		if visiting[n] {
+			return nil
+		}
+		if visiting == nil {
+			visiting = make(map[*lua.LTable]bool)
+		}
+		visiting[n] = true
+		defer delete(visiting, n)
+
+		if n.Len() > 0 && n.Len() == tableCount(n) {
+			arr := make([]interface{}, 0, n.Len())
+			for i := 1; i <= n.Len(); i++ {
+				arr = append(arr, tableToInterface(n.RawGetInt(i), visiting, opaque))
+			}
+			return arr
+		}
+		m := make(map[string]interface{})
+		n.ForEach(func(k lua.LValue, v lua.LValue) {
+			m[k.String()] = tableToInterface(v, visiting, opaque)
+		})
+		return m
+	default:
+		return nil
+	}
+}
+
+func tableCount(tb *lua.LTable) int {
+	count := 0
+	tb.ForEach(func(lua.LValue, lua.LValue) {
+		count++
+	})
+	return count
+}
+
+type pointerKey struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// valueToLua converts go values to lua tables and scalars, int64/uint64 become strings like get_number.
+// values deeper than depth and functions/channels are kept as userdata
+func valueToLua(state *lua.LState, v reflect.Value, depth int, seen map[pointerKey]*lua.LTable) lua.LValue {
+	if !v.IsValid() {
+		return lua.LNil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return lua.LBool(v.Bool())
+	case reflect.Int64:
+		return lua.LString(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint64:
+		return lua.LString(strconv.FormatUint(v.Uint(), 10))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return lua.LNumber(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uintptr:
+		return lua.LNumber(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return lua.LNumber(v.Float())
+	case reflect.String:
+		return lua.LString(v.String())
+	case reflect.Interface:
+		if v.IsNil() {
+			return lua.LNil
+		}
+		return valueToLua(state, v.Elem(), depth, seen)
+	case reflect.Ptr:
+		if v.IsNil() {
+			return lua.LNil
+		}
+		if tb, ok := seen[pointerKey{v.Pointer(), v.Type()}]; ok {
+			return tb
+		}
+		return valueToLua(state, v.Elem(), depth, seen)
+	}
+
+	if depth <= 0 {
+		return newUserData(state, v)
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		tb := state.NewTable()
+		if v.CanAddr() {
+			seen[pointerKey{v.UnsafeAddr(), reflect.PtrTo(v.Type())}] = tb
+		}
+		for i := 0; i < v.NumField(); i++ {
+			tb.RawSetString(v.Type().Field(i).Name, valueToLua(state, v.Field(i), depth-1, seen))
+		}
+		return tb
+	case reflect.Map:
+		if v.IsNil() {
+			return lua.LNil
+		}
+		key := pointerKey{v.Pointer(), v.Type()}
+		if tb, ok := seen[key]; ok {
+			return tb
+		}
+		tb := state.NewTable()
+		seen[key] = tb
+		iter := v.MapRange()
+		for iter.Next() {
+			k := valueToLua(state, iter.Key(), depth-1, seen)
+			if k == lua.LNil {
+				continue
+			}
+			tb.RawSet(k, valueToLua(state, iter.Value(), depth-1, seen))
+		}
+		return tb
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return lua.LNil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			return lua.LString(v.Bytes())
+		}
+		tb := state.NewTable()
+		for i := 0; i < v.Len(); i++ {
+			tb.RawSetInt(i+1, valueToLua(state, v.Index(i), depth-1, seen))
+		}
+		return tb
+	default:
+		return newUserData(state, v)
+	}
+}
+
+func lToLua(state *lua.LState) int {
+	ud := state.CheckUserData(1)
+	depth := state.OptInt(2, defaultToLuaDepth)
+
+	state.Push(valueToLua(state, userDataValue(ud), depth, make(map[pointerKey]*lua.LTable)))
+	return 1
+}
+
+func lFromLua(state *lua.LState) int {
+	ctx := getContext(state)
+	lv := state.Get(1)
+
+	var t reflect.Type
+	switch typ := state.Get(2).(type) {
+	case lua.LString:
+		name := string(typ)
+		ptr := strings.HasPrefix(name, "*")
+		name = strings.TrimPrefix(name, "*")
+		ctx.checkSymbol(state, "from_lua", name)
+		var err error
+		if t, err = ctx.dwarf.FindType(name); err != nil {
+			state.RaiseError(fmt.Sprintf("type:%s not found", name))
+		}
+		if ptr {
+			t = reflect.PtrTo(t)
+		}
+	case *lua.LUserData:
+		switch to := typ.Value.(type) {
+		case reflect.Type:
+			t = to
+		case reflect.Value:
+			t = to.Type()
+		default:
+			t = reflect.TypeOf(to)
+		}
+	default:
+		state.RaiseError("param2 need type name/reflect.Type")
+	}
+
+	v, err := luaToValue(lv, t)
+	if err != nil {
+		state.RaiseError(err.Error())
+	}
+	state.Push(newUserData(state, v))
+	return 1
+}
@@ -0,0 +1,83 @@
+package go_watch
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNumberOverflow(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		to   interface{}
+		want bool
+	}{
+		{int64(1 << 40), int32(0), true},
+		{int64(math.MaxInt32), int32(0), false},
+		{int64(math.MinInt32), int32(0), false},
+		{int64(math.MinInt32 - 1), int32(0), true},
+		{int(-1), uint(0), true},
+		{int(255), uint8(0), false},
+		{int(256), uint8(0), true},
+		{uint64(math.MaxUint64), int64(0), true},
+		{uint64(math.MaxInt64), int64(0), false},
+		{uint32(math.MaxUint32), uint16(0), true},
+		{uint16(math.MaxUint16), uint32(0), false},
+		{float64(1.5), int8(0), false},
+		{float64(128), int8(0), true},
+		{float64(-129), int8(0), true},
+		{float64(1 << 63), int64(0), true},
+		{float64(-1 << 63), int64(0), false},
+		{math.NaN(), int(0), true},
+		{math.Inf(1), int(0), true},
+		{float64(-0.5), uint(0), false},
+		{float64(-1), uint(0), true},
+		{float64(1 << 64), uint64(0), true},
+		{float64(1e39), float32(0), true},
+		{float64(1e38), float32(0), false},
+		{math.Inf(-1), float32(0), false},
+		{int64(math.MaxInt64), float32(0), false},
+		{uint64(math.MaxUint64), float64(0), false},
+	}
+
+	for _, tt := range tests {
+		if got := numberOverflow(reflect.ValueOf(tt.v), reflect.TypeOf(tt.to)); got != tt.want {
+			t.Errorf("numberOverflow(%T(%v), %T) = %v, want %v", tt.v, tt.v, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestConvertUserData(t *testing.T) {
+	tests := []struct {
+		script string
+		err    string // part of the error message, empty for success
+		level  int32
+	}{
+		{script: `role.Level = go_watch.new_int64(5)`, level: 5},
+		{script: `role.Level = go_watch.new_uint8(200)`, level: 200},
+		{script: `role.Level = go_watch.new_int64(1099511627776)`, err: "overflow int32"},
+		{script: `role.Level = go_watch.new_uint64(4294967295)`, err: "overflow int32"},
+		{script: `go_watch.set_path(role, "Level", go_watch.new_int64(-2147483649))`, err: "overflow int32"},
+		{script: `role.SetName(go_watch.new_int(1))`, err: "type mismatch"},
+	}
+
+	for _, tt := range tests {
+		role := &testRole{}
+		state, _ := newTestState(t, role)
+		err := Execute(state, testScript(tt.script), 1)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error = %v, want %q", tt.script, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.script, err)
+			continue
+		}
+		if role.Level != tt.level {
+			t.Errorf("%s: Level = %d, want %d", tt.script, role.Level, tt.level)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package go_watch
+
+import (
+	"fmt"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// PanicError is a go panic recovered inside an export
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("go panic: %v\n%s", e.Value, e.Stack)
+}
+
+// ScriptError is returned by Execute when the script raised an error
+type ScriptError struct {
+	Session   int
+	Line      int    // script line of the error, 0 if unknown
+	Message   string // lua error message
+	Traceback string // lua stack traceback
+	Err       error  // go error behind the lua error: *PanicError, *PermissionError or *TimeoutError
+}
+
+func (e *ScriptError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "session:%d", e.Session)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, " line:%d", e.Line)
+	}
+	b.WriteString(" ")
+	b.WriteString(e.Message)
+	if e.Traceback != "" {
+		b.WriteString("\n")
+		b.WriteString(e.Traceback)
+	}
+	return b.String()
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// the script is loaded with chunk name "script", compile errors look like "script line:3(column:5) ..."
+var scriptLineRegexp = regexp.MustCompile(`\bscript(?::| line:)(\d+)`)
+
+func newScriptError(session int, msg string, err error) *ScriptError {
+	scriptErr := &ScriptError{Session: session, Message: strings.TrimSpace(msg)}
+	// debug.traceback appends "\nstack traceback:\n..." to the message
+	if i := strings.Index(msg, "stack traceback:"); i >= 0 {
+		scriptErr.Message = strings.TrimSpace(msg[:i])
+		scriptErr.Traceback = trimTraceback(msg[i:])
+	}
+	// a go error recovered by pcall in the script is not the cause
+	if _, ok := err.(*TimeoutError); ok || (err != nil && strings.Contains(msg, firstLine(err.Error()))) {
+		scriptErr.Err = err
+	}
+
+	for _, s := range []string{scriptErr.Message, scriptErr.Traceback} {
+		if m := scriptLineRegexp.FindStringSubmatch(s); m != nil {
+			scriptErr.Line, _ = strconv.Atoi(m[1])
+			break
+		}
+	}
+	return scriptErr
+}
+
+// trimTraceback drops the frames of the Execute template below the script
+func trimTraceback(tb string) string {
+	lines := strings.Split(tb, "\n")
+	for i, line := range lines {
+		if strings.Contains(line, "in function 'xpcall'") {
+			return strings.Join(lines[:i], "\n")
+		}
+	}
+	return tb
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// recoverExport turns go panics in fn into lua errors, lua errors are passed through
+func (ctx *Context) recoverExport(fn lua.LGFunction) lua.LGFunction {
+	return func(state *lua.LState) (ret int) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			if _, ok := r.(*lua.ApiError); ok {
+				panic(r)
+			}
+			err := &PanicError{Value: r, Stack: debug.Stack()}
+			ctx.err = err
+			state.RaiseError(err.Error())
+		}()
+		return fn(state)
+	}
+}
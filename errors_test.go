@@ -0,0 +1,95 @@
+package go_watch
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestNewScriptError(t *testing.T) {
+	panicErr := &PanicError{Value: "index out of range", Stack: []byte("goroutine 1 [running]:\nmain.main()")}
+	timeoutErr := &TimeoutError{Session: 1, Err: context.DeadlineExceeded}
+
+	tests := []struct {
+		name      string
+		msg       string
+		err       error
+		line      int
+		message   string
+		traceback string
+		wantErr   error
+	}{
+		{
+			name:    "runtime error",
+			msg:     "script:3: attempt to index a nil value",
+			line:    3,
+			message: "script:3: attempt to index a nil value",
+		},
+		{
+			name:    "compile error",
+			msg:     "script line:12(column:5) near 'end':   syntax error\n",
+			line:    12,
+			message: "script line:12(column:5) near 'end':   syntax error",
+		},
+		{
+			name:      "traceback",
+			msg:       "script:7: boom\nstack traceback:\n\t[G]: in function 'error'\n\tscript:7: in main chunk\n\t[G]: in function 'xpcall'\n\t<string>:26: in main chunk",
+			line:      7,
+			message:   "script:7: boom",
+			traceback: "stack traceback:\n\t[G]: in function 'error'\n\tscript:7: in main chunk",
+		},
+		{
+			name:      "line from traceback",
+			msg:       "bad argument #1 to get_number\nstack traceback:\n\t[G]: in function 'get_number'\n\tscript:4: in main chunk\n\t[G]: in function 'xpcall'",
+			line:      4,
+			message:   "bad argument #1 to get_number",
+			traceback: "stack traceback:\n\t[G]: in function 'get_number'\n\tscript:4: in main chunk",
+		},
+		{
+			name:    "no line",
+			msg:     "script interrupted:context deadline exceeded",
+			err:     timeoutErr,
+			message: "script interrupted:context deadline exceeded",
+			wantErr: timeoutErr,
+		},
+		{
+			name:    "not a script chunk",
+			msg:     "myscript:3: error",
+			message: "myscript:3: error",
+		},
+		{
+			name:    "go panic",
+			msg:     "script:2: go panic: index out of range\ngoroutine 1 [running]:",
+			err:     panicErr,
+			line:    2,
+			message: "script:2: go panic: index out of range\ngoroutine 1 [running]:",
+			wantErr: panicErr,
+		},
+		{
+			name:    "go panic caught by pcall",
+			msg:     "script:9: other error",
+			err:     panicErr,
+			line:    9,
+			message: "script:9: other error",
+		},
+	}
+
+	for _, tt := range tests {
+		got := newScriptError(1, tt.msg, tt.err)
+		if got.Line != tt.line {
+			t.Errorf("%s: Line = %d, want %d", tt.name, got.Line, tt.line)
+		}
+		if got.Message != tt.message {
+			t.Errorf("%s: Message = %q, want %q", tt.name, got.Message, tt.message)
+		}
+		if got.Traceback != tt.traceback {
+			t.Errorf("%s: Traceback = %q, want %q", tt.name, got.Traceback, tt.traceback)
+		}
+		if got.Err != tt.wantErr {
+			t.Errorf("%s: Err = %v, want %v", tt.name, got.Err, tt.wantErr)
+		}
+		if tt.wantErr != nil && !errors.Is(got, tt.wantErr) {
+			t.Errorf("%s: errors.Is(%v) = false", tt.name, tt.wantErr)
+		}
+	}
+}
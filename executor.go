@@ -0,0 +1,128 @@
+package go_watch
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Executor runs every value-touching export, so scripts access program state on the right goroutine
+type Executor interface {
+	Run(fn func())
+}
+
+type ExecutorFunc func(fn func())
+
+func (f ExecutorFunc) Run(fn func()) {
+	f(fn)
+}
+
+// DirectExecutor runs exports on the goroutine calling Execute
+var DirectExecutor Executor = ExecutorFunc(func(fn func()) {
+	fn()
+})
+
+// LockExecutor runs exports while holding locker
+func LockExecutor(locker sync.Locker) Executor {
+	return ExecutorFunc(func(fn func()) {
+		locker.Lock()
+		defer locker.Unlock()
+		fn()
+	})
+}
+
+// ContextExecutor stops waiting for fn once ctx is done, ctx is the one given to ExecuteContext.
+// it returns ctx.Err() when fn did not run
+type ContextExecutor interface {
+	Executor
+	RunContext(ctx context.Context, fn func()) error
+}
+
+// ChanExecutor posts exports to an actor loop and waits for them to finish,
+// the loop runs `for fn := range ch { fn() }`.
+// Execute must not be called on the loop goroutine, it would wait for itself forever,
+// run scripts on another goroutine and use ExecuteContext to give up when the loop is busy or gone
+func ChanExecutor(ch chan<- func()) Executor {
+	return chanExecutor(ch)
+}
+
+type chanExecutor chan<- func()
+
+func (ch chanExecutor) Run(fn func()) {
+	ch.RunContext(context.Background(), fn)
+}
+
+func (ch chanExecutor) RunContext(ctx context.Context, fn func()) error {
+	const (
+		pending int32 = iota
+		running
+		canceled
+	)
+	var status int32
+	done := make(chan struct{})
+	post := func() {
+		if !atomic.CompareAndSwapInt32(&status, pending, running) {
+			return
+		}
+		defer close(done)
+		fn()
+	}
+
+	select {
+	case ch <- post:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		// fn uses the lua state, once started it must finish before the script goes on
+		if atomic.CompareAndSwapInt32(&status, pending, canceled) {
+			return ctx.Err()
+		}
+		<-done
+		return nil
+	}
+}
+
+func WithExecutor(executor Executor) Option {
+	return func(ctx *Context) {
+		ctx.executor = executor
+	}
+}
+
+func (ctx *Context) executorExport(fn lua.LGFunction) lua.LGFunction {
+	return func(state *lua.LState) int {
+		// callbacks from map_foreach/array_foreach are already inside the executor
+		if ctx.executing {
+			return fn(state)
+		}
+
+		var ret int
+		var rcv interface{}
+		run := func() {
+			ctx.executing = true
+			defer func() {
+				ctx.executing = false
+				rcv = recover()
+			}()
+			ret = fn(state)
+		}
+		if executor, ok := ctx.executor.(ContextExecutor); ok && state.Context() != nil {
+			if err := executor.RunContext(state.Context(), run); err != nil {
+				ctx.err = &TimeoutError{Session: ctx.session, Err: err}
+				state.RaiseError("script interrupted:" + err.Error())
+			}
+		} else {
+			ctx.executor.Run(run)
+		}
+		// lua errors are panics, rethrow them on the lua goroutine
+		if rcv != nil {
+			panic(rcv)
+		}
+		return ret
+	}
+}
@@ -0,0 +1,138 @@
+package go_watch
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testExecutor counts the functions it runs and marks the time they run
+type testExecutor struct {
+	mu      sync.Mutex
+	runs    int
+	running bool
+}
+
+func (e *testExecutor) Run(fn func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.runs++
+	e.running = true
+	defer func() { e.running = false }()
+	fn()
+}
+
+func TestResultsOnExecutor(t *testing.T) {
+	executor := &testExecutor{}
+	role := &testRole{ID: 7}
+	state, _ := newTestState(t, role, WithExecutor(executor))
+
+	results, err := ExecuteWithResult(state, `return 1`, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if executor.runs != 1 || !reflect.DeepEqual(results, []interface{}{float64(1)}) {
+		t.Errorf("runs = %d results = %v, want 1 [1]", executor.runs, results)
+	}
+
+	pool, err := NewPool(func(name string) interface{} { return role }, func(int, string) {}, nil, 1, WithExecutor(executor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	executor.runs = 0
+	results, err = pool.ExecuteWithResult(context.Background(), testScript(`return role.ID`), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// root_get, get_path and the results
+	if executor.runs != 3 || !reflect.DeepEqual(results, []interface{}{7}) {
+		t.Errorf("pool runs = %d results = %v, want 3 [7]", executor.runs, results)
+	}
+}
+
+func TestExecutorRouting(t *testing.T) {
+	executor := &testExecutor{}
+	role := &testRole{ID: 7}
+	var rootInExecutor bool
+	out := &testOutput{}
+	state, err := NewLuaState(func(name string) interface{} {
+		rootInExecutor = executor.running
+		return role
+	}, out.print, WithExecutor(executor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if err := Execute(state, testScript(`print("a")`), 1); err != nil {
+		t.Fatal(err)
+	}
+	// root_get runs on the executor, print does not
+	if executor.runs != 1 || !rootInExecutor {
+		t.Errorf("runs = %d, root in executor = %v, want 1 true", executor.runs, rootInExecutor)
+	}
+
+	executor.runs = 0
+	if err := Execute(state, testScript(`go_watch.set_number(role.ID, 8) role.SetName("b")`), 1); err != nil {
+		t.Fatal(err)
+	}
+	// root_get, get_path for role.ID, set_number, get_path for role.SetName and call
+	if executor.runs != 5 || role.ID != 8 || role.Name != "b" {
+		t.Errorf("runs = %d, role = %+v", executor.runs, role)
+	}
+
+	// callbacks of map_foreach already run inside the executor
+	executor.runs = 0
+	role.Attrs = map[string]int{"a": 1, "b": 2}
+	if err := Execute(state, testScript(`go_watch.map_foreach(role.Attrs, function(k, v) go_watch.get_number(v) return 1 end)`), 1); err != nil {
+		t.Fatal(err)
+	}
+	if executor.runs != 3 {
+		t.Errorf("map_foreach runs = %d, want 3", executor.runs)
+	}
+}
+
+func TestChanExecutor(t *testing.T) {
+	ch := make(chan func())
+	role := &testRole{ID: 7}
+	state, _ := newTestState(t, role, WithExecutor(ChanExecutor(ch)))
+
+	// nobody runs the loop yet, the script gives up at the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err := ExecuteContext(ctx, state, testScript(`go_watch.set_number(role.ID, 8)`), 1)
+	cancel()
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || !timeoutErr.Timeout() {
+		t.Fatalf("error = %v, want timeout", err)
+	}
+
+	loop := make(chan int64, 1)
+	go func() {
+		for fn := range ch {
+			fn()
+		}
+		loop <- 0
+	}()
+	defer func() {
+		close(ch)
+		<-loop
+	}()
+
+	if err := Execute(state, testScript(`go_watch.set_number(role.ID, 8)`), 1); err != nil {
+		t.Fatal(err)
+	}
+	if role.ID != 8 {
+		t.Errorf("ID = %d, want 8", role.ID)
+	}
+	results, err := ExecuteWithResult(state, testScript(`return role.ID, {1, "a"}`), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{8, []interface{}{float64(1), "a"}}; !reflect.DeepEqual(results, want) {
+		t.Errorf("results = %#v, want %#v", results, want)
+	}
+}
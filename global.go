@@ -0,0 +1,49 @@
+package go_watch
+
+import (
+	"fmt"
+	"reflect"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// findGlobal returns the addressable view of a global's memory, typed by dwarf
+func (ctx *Context) findGlobal(state *lua.LState, export string, name string) reflect.Value {
+	ctx.checkSymbol(state, export, name)
+	global, err := ctx.dwarf.FindGlobal(name)
+	if err != nil || !global.IsValid() {
+		state.RaiseError(fmt.Sprintf("global:%s not found", name))
+	}
+	if !global.CanSet() {
+		state.RaiseError(fmt.Sprintf("global:%s not addressable", name))
+	}
+	return global
+}
+
+// lGlobalGet(name) returns the global itself, writes through the returned value change the global
+func lGlobalGet(state *lua.LState) int {
+	ctx := getContext(state)
+	name := state.CheckString(1)
+
+	global := ctx.findGlobal(state, "global_get", name)
+	state.Push(newUserData(state, global))
+	return 1
+}
+
+// lGlobalSet(name, value) converts value to the type of the global declared in dwarf
+func lGlobalSet(state *lua.LState) int {
+	ctx := getContext(state)
+	name := state.CheckString(1)
+	value := state.Get(2)
+
+	global := ctx.findGlobal(state, "global_set", name)
+	rv, err := luaToValue(value, global.Type())
+	if err != nil {
+		state.RaiseError(fmt.Sprintf("global:%s %s", name, err.Error()))
+	}
+
+	audit := ctx.auditWrite("global_set", global.Type(), name, global)
+	global.Set(rv)
+	audit(global)
+	return 0
+}
@@ -5,6 +5,7 @@ go 1.17
 require (
 	github.com/lsg2020/gort v0.0.0-20220515065520-122216bbbe0e
 	github.com/yuin/gopher-lua v0.0.0-20210529063254-f4c35e4016d9
+	golang.org/x/arch v0.0.0-20190927153633-4e8777c89be4
 )
 
 require (
@@ -13,6 +14,5 @@ require (
 	github.com/hashicorp/golang-lru v0.5.4 // indirect
 	github.com/konsorten/go-windows-terminal-sequences v1.0.3 // indirect
 	github.com/sirupsen/logrus v1.6.0 // indirect
-	golang.org/x/arch v0.0.0-20190927153633-4e8777c89be4 // indirect
 	golang.org/x/sys v0.0.0-20211117180635-dee7805ff2e1 // indirect
 )
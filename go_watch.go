@@ -1,10 +1,13 @@
 package go_watch
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"runtime"
+	"runtime/debug"
 	"strconv"
-	"strings"
 	"unsafe"
 
 	"github.com/lsg2020/gort"
@@ -15,6 +18,7 @@ const moduleName = "go_watch"
 const debugCtx = "go_watch_debug_ctx"
 
 var exports map[string]lua.LGFunction
+var readExports map[string]bool
 
 func init() {
 	exports = map[string]lua.LGFunction{
@@ -27,6 +31,15 @@ func init() {
 		"get_type_with_name":   lGetTypeWithName,
 		"get_obj_type":         lGetObjType,
 		"get_global_with_name": lGetGlobalWithName,
+		"type_info":            lTypeInfo,
+		"global_get":           lGlobalGet,
+		"global_set":           lGlobalSet,
+		"global_replace":       lGlobalReplace,
+		"global_restore":       lGlobalRestore,
+		"trace_func":           lTraceFunc,
+		"goroutines":           lGoroutines,
+		"goroutine_count":      lGoroutineCount,
+		"find_instances":       lFindInstances,
 
 		"clone":               lClone,
 		"ptr_to_val":          lPtrToVal,
@@ -37,9 +50,14 @@ func init() {
 		"to_string":           lToString,
 		"rval_to_interface":   lRValToInterface,
 		"interface_to_rval":   lInterfaceToRVal,
+		"to_json":             lToJSON,
+		"to_lua":              lToLua,
+		"from_lua":            lFromLua,
 
 		"field_get_by_name": lFieldGetByName,
 		"field_set_by_name": lFieldSetByName,
+		"get_path":          lGetPath,
+		"set_path":          lSetPath,
 
 		"map_get":     lMapGet,
 		"map_set":     lMapSet,
@@ -82,33 +100,155 @@ func init() {
 		"new_with_name": lNewWithName,
 		"new_interface": lNewInterface,
 	}
+
+	// readExports only read program state or create new values, read-only mode rejects every other export,
+	// so new exports are writable only after they are listed here
+	readExports = map[string]bool{
+		"root_get": true,
+		"print":    true,
+
+		"search_type_name":     true,
+		"search_func_name":     true,
+		"search_global_name":   true,
+		"get_type_with_name":   true,
+		"get_obj_type":         true,
+		"get_global_with_name": true,
+		"type_info":            true,
+		"global_get":           true,
+		"goroutines":           true,
+		"goroutine_count":      true,
+		"find_instances":       true,
+
+		"clone":             true,
+		"ptr_to_val":        true,
+		"val_to_ptr":        true,
+		"convert_type_to":   true,
+		"to_string":         true,
+		"rval_to_interface": true,
+		"interface_to_rval": true,
+		"to_json":           true,
+		"to_lua":            true,
+		"from_lua":          true,
+
+		"field_get_by_name": true,
+		"get_path":          true,
+
+		"map_get":     true,
+		"map_foreach": true,
+		"map_new_key": true,
+		"map_new_val": true,
+		"map_make":    true,
+
+		"array_new_elem": true,
+		"array_foreach":  true,
+		"array_get":      true,
+		"array_slice":    true,
+		"slice_make":     true,
+
+		"get_string":   true,
+		"get_number":   true,
+		"get_boolean":  true,
+		"get_len":      true,
+		"get_type_str": true,
+		"get_pointer":  true,
+
+		"new_boolean":   true,
+		"new_int":       true,
+		"new_int8":      true,
+		"new_int16":     true,
+		"new_int32":     true,
+		"new_int64":     true,
+		"new_uint8":     true,
+		"new_uint16":    true,
+		"new_uint32":    true,
+		"new_uint64":    true,
+		"new_string":    true,
+		"new_with_name": true,
+		"new_interface": true,
+	}
 }
 
 type RootFunc func(name string) interface{}
 type PrintFunc func(session int, str string)
 type Context struct {
-	root  RootFunc
-	print PrintFunc
-	dwarf *gort.DwarfRT
+	root      RootFunc
+	print     PrintFunc
+	dwarf     *symbols
+	readOnly  bool
+	sandbox   bool // no io, os or lua file loading, implied by readOnly
+	quietDeny bool // denials are only raised, not printed
+	policy    Policy
+	audit     AuditFunc
+	trace     TraceFunc
+	swapErr   SwapErrorFunc
+	executor  Executor
+	session   int
+	opts      []Option
+	keepEnv   bool        // globals set by scripts survive between executions
+	env       *lua.LTable // script globals when keepEnv
+	err       error       // go error behind the last lua error of the running script
+
+	executing bool
 }
 
-func NewLuaState(root RootFunc, print PrintFunc) (*lua.LState, error) {
-	dwarf, err := gort.NewDwarfRT("")
-	if err != nil {
-		return nil, err
+type Option func(ctx *Context)
+
+// WithReadOnly only allows the exports in readExports, the rest modify program state or call functions
+func WithReadOnly() Option {
+	return func(ctx *Context) {
+		ctx.readOnly = true
+	}
+}
+
+// sandbox is for states running scripts from the network, like those of the http handler
+func sandbox() Option {
+	return func(ctx *Context) {
+		ctx.sandbox = true
+	}
+}
+
+// quietDeny is for states whose errors are returned to the user anyway, printing a denial first
+// would make the http handler send it with status 200 before the error
+func quietDeny() Option {
+	return func(ctx *Context) {
+		ctx.quietDeny = true
+	}
+}
+
+// keepEnv is for states serving one session, like those of the http handler
+func keepEnv() Option {
+	return func(ctx *Context) {
+		ctx.keepEnv = true
 	}
-	return NewLuaStateEx(root, print, dwarf)
 }
 
-func NewLuaStateEx(root RootFunc, print PrintFunc, dwarf *gort.DwarfRT) (*lua.LState, error) {
-	ctx := &Context{root: root, print: print, dwarf: dwarf}
+// NewLuaState uses the debug info of the current executable, it is loaded on first use and shared by all states
+func NewLuaState(root RootFunc, print PrintFunc, opts ...Option) (*lua.LState, error) {
+	return newLuaState(root, print, defaultSymbols, opts...)
+}
+
+func NewLuaStateEx(root RootFunc, print PrintFunc, dwarf *gort.DwarfRT, opts ...Option) (*lua.LState, error) {
+	return newLuaState(root, print, newSymbols(dwarf), opts...)
+}
 
-	state := lua.NewState()
+func newLuaState(root RootFunc, print PrintFunc, dwarf *symbols, opts ...Option) (*lua.LState, error) {
+	ctx := &Context{root: root, print: print, dwarf: dwarf, opts: opts}
+	for _, opt := range opts {
+		opt(ctx)
+	}
+
+	var state *lua.LState
+	if ctx.sandbox || ctx.readOnly {
+		state = newSandboxState()
+	} else {
+		state = lua.NewState()
+	}
 	ud := newUserData(state, ctx)
 	state.SetGlobal(debugCtx, ud)
+	ctx.registerValueMeta(state)
 
 	state.PreloadModule(moduleName, func(state *lua.LState) int {
-		mod := state.SetFuncs(state.NewTable(), exports)
+		mod := state.SetFuncs(state.NewTable(), ctx.exports())
 		state.Push(mod)
 		return 1
 	})
@@ -116,32 +256,175 @@ func NewLuaStateEx(root RootFunc, print PrintFunc, dwarf *gort.DwarfRT) (*lua.LS
 	return state, nil
 }
 
+var sandboxLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.LoadLibName, lua.OpenPackage},
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+	{lua.CoroutineLibName, lua.OpenCoroutine},
+	{lua.DebugLibName, lua.OpenDebug},
+}
+
+// newSandboxState leaves out the io and os libraries, dofile, loadfile and loading lua files by require,
+// so scripts can not run commands or touch files. debug only keeps traceback for the script template
+func newSandboxState() *lua.LState {
+	state := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range sandboxLibs {
+		state.Push(state.NewFunction(lib.open))
+		state.Push(lua.LString(lib.name))
+		state.Call(1, 0)
+	}
+	state.SetGlobal("dofile", lua.LNil)
+	state.SetGlobal("loadfile", lua.LNil)
+
+	// require only finds preloaded modules like go_watch
+	loaders := state.GetField(state.Get(lua.RegistryIndex), "_LOADERS").(*lua.LTable)
+	for loaders.Len() > 1 {
+		loaders.Remove(loaders.Len())
+	}
+	pkg := state.GetGlobal(lua.LoadLibName)
+	state.SetField(pkg, "path", lua.LString(""))
+
+	debugLib := state.NewTable()
+	debugLib.RawSetString("traceback", state.GetField(state.GetGlobal(lua.DebugLibName), "traceback"))
+	state.SetGlobal(lua.DebugLibName, debugLib)
+	state.SetField(state.GetField(pkg, "loaded"), lua.DebugLibName, debugLib)
+	return state
+}
+
+type TimeoutError struct {
+	Session int
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("session:%d script interrupted:%s", e.Session, e.Err.Error())
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return e.Err == context.DeadlineExceeded
+}
+
 func Execute(state *lua.LState, script string, session int) error {
-	codeTemplate := `
-		local go_watch = require("go_watch")
-		local session = %d
+	return ExecuteContext(context.Background(), state, script, session)
+}
+
+// ExecuteContext aborts the script once ctx is done, errors are returned as *ScriptError.
+// ScriptError.Err is *TimeoutError when interrupted
+func ExecuteContext(ctx context.Context, state *lua.LState, script string, session int) error {
+	_, err := execute(ctx, state, script, session)
+	return err
+}
+
+// ExecuteWithResult returns the values returned by the script.
+// tables become []interface{} or map[string]interface{}, userdata the go values,
+// values that can not be exported like unexported fields become json.RawMessage
+func ExecuteWithResult(state *lua.LState, script string, session int) ([]interface{}, error) {
+	rets, err := execute(context.Background(), state, script, session)
+	if err != nil {
+		return nil, err
+	}
+	return scriptResults(context.Background(), state, rets, session)
+}
+
+// scriptResults converts rets on the executor, Interface and to_json read program state like the exports do
+func scriptResults(ctx context.Context, state *lua.LState, rets []lua.LValue, session int) ([]interface{}, error) {
+	watchCtx := lookupContext(state)
+	if watchCtx == nil || watchCtx.executor == nil {
+		return luaResults(rets), nil
+	}
+
+	var results []interface{}
+	var panicErr *PanicError
+	run := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicErr = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}()
+		results = luaResults(rets)
+	}
+	if executor, ok := watchCtx.executor.(ContextExecutor); ok && ctx.Done() != nil {
+		if err := executor.RunContext(ctx, run); err != nil {
+			return nil, newScriptError(session, "script interrupted:"+err.Error(), &TimeoutError{Session: session, Err: err})
+		}
+	} else {
+		watchCtx.executor.Run(run)
+	}
+	if panicErr != nil {
+		return nil, newScriptError(session, panicErr.Error(), panicErr)
+	}
+	return results, nil
+}
+
+func luaResults(rets []lua.LValue) []interface{} {
+	results := make([]interface{}, len(rets))
+	for i, ret := range rets {
+		results[i] = tableToInterface(ret, nil, jsonResult)
+	}
+	return results
+}
+
+func jsonResult(v reflect.Value) interface{} {
+	str, err := toJSON(v, jsonOptions{maxDepth: defaultJSONMaxDepth, maxElems: defaultJSONMaxElems})
+	if err != nil {
+		return nil
+	}
+	return json.RawMessage(str)
+}
+
+// scriptHelpers needs the locals go_watch and session
+const scriptHelpers = `
 		local function debug_print(...)
-			local args = {...}
 			local out = {}
-			for k, v in ipairs(args) do
-				out[k] = tostring(v)
+			for k = 1, select('#', ...) do
+				out[k] = tostring((select(k, ...)))
 			end
 			out = table.concat(out, '\t')
 			go_watch.print(session, out)
 		end
-		local env = setmetatable({print=debug_print}, {__index=_G})
-		local f = loadstring(%q)
+		local function debug_pairs(t)
+			local mt = getmetatable(t)
+			if type(mt) == "table" and mt.__pairs then
+				return mt.__pairs(t)
+			end
+			return pairs(t)
+		end
+`
+
+func execute(ctx context.Context, state *lua.LState, script string, session int) ([]lua.LValue, error) {
+	codeTemplate := `
+		local go_watch = require("go_watch")
+		local session = %d
+` + scriptHelpers + `
+		local env = ... or setmetatable({}, {__index=_G})
+		env.print, env.pairs = debug_print, debug_pairs
+		local f, err = loadstring(%q, "script")
+		if not f then
+			error(err, 0)
+		end
 		setfenv(f, env)
-		local r, err = xpcall(f, debug.traceback)
-		if not r then
-			go_watch.print(session, err)
-			return
+		local function pack(...)
+			return select('#', ...), {...}
 		end
+		local n, results = pack(xpcall(f, debug.traceback))
+		if not results[1] then
+			error(results[2], 0)
+		end
+		return unpack(results, 2, n)
 	`
 
 	fn, err := state.LoadString(`local template, session, script = ...; return string.format(template, session, script); `)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	state.Push(fn)
@@ -151,20 +434,105 @@ func Execute(state *lua.LState, script string, session int) error {
 
 	err = state.PCall(3, 1, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	code := state.CheckString(-1)
 	state.Pop(1)
 
-	err = state.DoString(code)
-	return err
+	watchCtx := lookupContext(state)
+	var env lua.LValue = lua.LNil
+	if watchCtx != nil {
+		watchCtx.session = session
+		watchCtx.err = nil
+		if watchCtx.keepEnv {
+			if watchCtx.env == nil {
+				watchCtx.env = state.NewTable()
+				meta := state.NewTable()
+				meta.RawSetString("__index", state.G.Global)
+				state.SetMetatable(watchCtx.env, meta)
+			}
+			env = watchCtx.env
+		}
+	}
 
+	if ctx.Done() != nil {
+		state.SetContext(ctx)
+		defer state.RemoveContext()
+	}
+
+	top := state.GetTop()
+	fn, err = state.LoadString(code)
+	if err == nil {
+		state.Push(fn)
+		state.Push(env)
+		err = state.PCall(1, lua.MultRet, nil)
+	}
+	var rets []lua.LValue
+	if err == nil {
+		for i := top + 1; i <= state.GetTop(); i++ {
+			rets = append(rets, state.Get(i))
+		}
+		state.SetTop(top)
+	}
+
+	var goErr error
+	if watchCtx != nil {
+		goErr = watchCtx.err
+	}
+	if err == nil {
+		return rets, nil
+	}
+	// a script finishing right at the deadline keeps its results
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// the interrupt is raised outside the script, so there is no line
+		return nil, newScriptError(session, "script interrupted:"+ctxErr.Error(), &TimeoutError{Session: session, Err: ctxErr})
+	}
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		return nil, newScriptError(session, apiErr.Object.String(), goErr)
+	}
+	return rets, err
+}
+
+func (ctx *Context) exports() map[string]lua.LGFunction {
+	funcs := make(map[string]lua.LGFunction, len(exports))
+	for name, fn := range exports {
+		funcs[name] = ctx.wrapExport(name, fn)
+	}
+	return funcs
+}
+
+// wrapExport applies read-only mode, executor and policy to fn, metamethods are checked as the export named
+func (ctx *Context) wrapExport(name string, fn lua.LGFunction) lua.LGFunction {
+	if ctx.readOnly && !readExports[name] {
+		return ctx.denyExport(&PermissionError{Export: name, Reason: "not allowed in read-only mode"})
+	}
+	fn = ctx.recoverExport(fn)
+	if name == "print" {
+		return fn
+	}
+	if ctx.executor != nil {
+		fn = ctx.executorExport(fn)
+	}
+	if ctx.policy != nil {
+		fn = ctx.policyExport(name, fn)
+	}
+	return fn
+}
+
+func (ctx *Context) denyExport(err *PermissionError) lua.LGFunction {
+	return func(state *lua.LState) int {
+		ctx.deny(state, err)
+		return 0
+	}
 }
 
 func newUserData(state *lua.LState, data interface{}) *lua.LUserData {
 	ud := state.NewUserData()
 	ud.Value = data
+	if _, ok := data.(*Context); !ok {
+		state.SetMetatable(ud, state.GetTypeMetatable(valueMetaName))
+	}
 	return ud
 }
 
@@ -181,6 +549,15 @@ func getContext(state *lua.LState) (ctx *Context) {
 	return
 }
 
+func lookupContext(state *lua.LState) *Context {
+	if ud, ok := state.GetGlobal(debugCtx).(*lua.LUserData); ok {
+		if ctx, ok := ud.Value.(*Context); ok {
+			return ctx
+		}
+	}
+	return nil
+}
+
 func lRootGet(state *lua.LState) int {
 	ctx := getContext(state)
 	name := state.CheckString(1)
@@ -201,31 +578,62 @@ func lPrint(state *lua.LState) int {
 }
 
 func lCall(state *lua.LState) int {
+	ctx := getContext(state)
 	ud := state.CheckUserData(1)
-	paramList := make([]reflect.Value, 0, state.GetTop()-1)
-	for i := 1; i < state.GetTop(); i++ {
-		p := state.CheckUserData(i + 1)
-		if r, ok := p.Value.(reflect.Value); ok {
-			paramList = append(paramList, r)
-		} else {
-			paramList = append(paramList, reflect.ValueOf(p.Value))
+
+	var rfn reflect.Value
+	var fnName string
+	switch v := ud.Value.(type) {
+	case *methodValue:
+		rfn, fnName = v.fn, v.symbol
+	case reflect.Value:
+		rfn = v
+	default:
+		rfn = reflect.ValueOf(ud.Value)
+	}
+
+	if rfn.Kind() == reflect.Ptr && rfn.Elem().Kind() == reflect.Func {
+		rfn = rfn.Elem()
+	}
+	if rfn.Kind() != reflect.Func {
+		state.RaiseError("param1 need function")
+	}
+	if rfn.IsNil() {
+		state.RaiseError("param1 nil function")
+	}
+	// closures are checked by the name of the function they were compiled from, methods by the name kept at lookup
+	if fnName == "" {
+		if f := runtime.FuncForPC(rfn.Pointer()); f != nil {
+			fnName = f.Name()
 		}
 	}
+	ctx.checkFunc(state, "call", fnName)
 
-	var rfn reflect.Value
-	if r, ok := ud.Value.(reflect.Value); ok {
-		rfn = r
+	args := make([]lua.LValue, 0, state.GetTop()-1)
+	for i := 2; i <= state.GetTop(); i++ {
+		args = append(args, state.Get(i))
+	}
+	// a slice passed as the last argument of a variadic function is spread like `fn(a, xs...)`
+	ftyp := rfn.Type()
+	spread := ftyp.IsVariadic() && len(args) == ftyp.NumIn() && assignableTo(args[len(args)-1], ftyp.In(ftyp.NumIn()-1))
+	var paramList []reflect.Value
+	var err error
+	if spread {
+		paramList, err = luaArgs(args[:len(args)-1], ftyp)
+		paramList = append(paramList, userDataValue(args[len(args)-1].(*lua.LUserData)))
 	} else {
-		rfn = reflect.ValueOf(ud.Value)
+		paramList, err = luaArgs(args, ftyp)
+	}
+	if err != nil {
+		state.RaiseError(err.Error())
 	}
 
+	ctx.auditCall("call", fnName, ftyp, paramList)
 	var ret []reflect.Value
-	if rfn.Kind() == reflect.Ptr && rfn.Elem().Kind() == reflect.Func {
-		ret = rfn.Elem().Call(paramList)
-	} else if rfn.Kind() == reflect.Func {
-		ret = rfn.Call(paramList)
+	if spread {
+		ret = rfn.CallSlice(paramList)
 	} else {
-		state.RaiseError("param1 need function")
+		ret = rfn.Call(paramList)
 	}
 
 	for _, r := range ret {
@@ -236,30 +644,46 @@ func lCall(state *lua.LState) int {
 	return len(ret)
 }
 
+// lCallFuncWithName supports
+//
+//	call_func_with_name(name, variadic, {args...})
+//	call_func_with_name(name, {args...})
+//	call_func_with_name(name, args...)
+//
+// variadic is detected from the function type when omitted
 func lCallFuncWithName(state *lua.LState) int {
 	ctx := getContext(state)
 
 	name := state.CheckString(1)
-	variadic := state.CheckBool(2)
-	in := state.CheckTable(3)
-
-	//inTypes := make([]reflect.Type, in.Len())
-	inValues := make([]reflect.Value, in.Len())
-	for i := 1; i <= in.Len(); i++ {
-		v := in.RawGetInt(i)
-		if ud, ok := v.(*lua.LUserData); ok {
-			if r, ok := ud.Value.(reflect.Value); ok {
-				//inTypes[i-1] = r.Type()
-				inValues[i-1] = r
-			} else {
-				//inTypes[i-1] = reflect.TypeOf(ud.Value)
-				inValues[i-1] = reflect.ValueOf(ud.Value)
-			}
-		} else {
-			state.RaiseError(fmt.Sprintf("in params:%d not user data", i))
+	ctx.checkSymbol(state, "call_func_with_name", name)
+
+	var args []lua.LValue
+	var variadic, explicit bool
+	if b, ok := state.Get(2).(lua.LBool); ok && state.GetTop() == 3 && state.Get(3).Type() == lua.LTTable {
+		variadic, explicit = bool(b), true
+		args = tableArgs(state.CheckTable(3))
+	} else if tb, ok := state.Get(2).(*lua.LTable); ok && state.GetTop() == 2 {
+		args = tableArgs(tb)
+	} else {
+		for i := 2; i <= state.GetTop(); i++ {
+			args = append(args, state.Get(i))
 		}
 	}
 
+	// lua values are converted to the parameter types declared in dwarf
+	ftyp, _ := ctx.dwarf.FindFuncType(name, false)
+	if !explicit {
+		variadic = detectVariadic(ftyp, args)
+	}
+	if variadic && ftyp != nil {
+		ftyp = variadicFuncOf(ftyp)
+	}
+	inValues, err := luaArgs(args, ftyp)
+	if err != nil {
+		state.RaiseError(err.Error())
+	}
+
+	ctx.auditCall("call_func_with_name", name, ftyp, inValues)
 	ret, err := ctx.dwarf.CallFunc(name, variadic, inValues)
 	if err != nil {
 		state.RaiseError(fmt.Sprintf("call func:%s err:%s", name, err.Error()))
@@ -271,68 +695,66 @@ func lCallFuncWithName(state *lua.LState) int {
 	return len(ret)
 }
 
+// lSearchFuncName(include [, opts]) returns the names and the count before paging, see searchOptions
 func lSearchFuncName(state *lua.LState) int {
 	ctx := getContext(state)
-	include := state.CheckString(1)
-
-	ret := &lua.LTable{}
-	err := ctx.dwarf.ForeachFunc(func(name string, pc uint64) {
-		if include == "" || strings.Index(name, include) >= 0 {
-			ret.Append(lua.LString(name))
-		}
-	})
+	idx, err := ctx.dwarf.Funcs()
 	if err != nil {
 		state.RaiseError(fmt.Sprintf("function search error:%s", err.Error()))
 	}
-
-	state.Push(ret)
-	return 1
+	return ctx.searchSymbols(state, "search_func_name", idx, true)
 }
 
+// lSearchGlobalName(include [, opts]) returns the names and the count before paging, see searchOptions
 func lSearchGlobalName(state *lua.LState) int {
 	ctx := getContext(state)
-	include := state.CheckString(1)
-
-	ret := &lua.LTable{}
-	err := ctx.dwarf.ForeachGlobal(func(name string, v reflect.Value) {
-		if include == "" || strings.Index(name, include) >= 0 {
-			ret.Append(lua.LString(name))
-		}
-	})
+	idx, err := ctx.dwarf.Globals()
 	if err != nil {
 		state.RaiseError(fmt.Sprintf("global search error:%s", err.Error()))
 	}
-
-	state.Push(ret)
-	return 1
+	return ctx.searchSymbols(state, "search_global_name", idx, false)
 }
 
-func lFieldGetByName(state *lua.LState) int {
-	ud := state.CheckUserData(1)
-	name := state.CheckString(2)
-
-	var rf reflect.Value
-	var rud reflect.Value
+func userDataValue(ud *lua.LUserData) reflect.Value {
 	if r, ok := ud.Value.(reflect.Value); ok {
-		rud = r
-	} else {
-		rud = reflect.ValueOf(ud.Value)
+		return r
 	}
+	if m, ok := ud.Value.(*methodValue); ok {
+		return m.fn
+	}
+	return reflect.ValueOf(ud.Value)
+}
+
+// fieldByName returns the field of a struct or struct pointer, unexported fields of addressable structs are writable
+func fieldByName(rud reflect.Value, name string) (reflect.Value, error) {
+	var rf reflect.Value
 	if rud.Kind() == reflect.Ptr && rud.Elem().Kind() == reflect.Struct {
-		rs := rud.Elem()
-		rf = rs.FieldByName(name)
-		rf = reflect.NewAt(rf.Type(), unsafe.Pointer(rf.UnsafeAddr())).Elem()
+		rf = rud.Elem().FieldByName(name)
 	} else if rud.Kind() == reflect.Struct {
-		/*
-			rs := rud
-			rs2 := reflect.New(rs.Type()).Elem()
-			rs2.Set(rs)
-			rf = rs2.FieldByName(name)
-			rf = reflect.NewAt(rf.Type(), unsafe.Pointer(rf.UnsafeAddr())).Elem()
-		*/
 		rf = rud.FieldByName(name)
 	} else {
-		state.RaiseError("param1 need struct")
+		return reflect.Value{}, fmt.Errorf("param1 need struct")
+	}
+	if !rf.IsValid() {
+		return reflect.Value{}, fmt.Errorf("field:%s not found in %s", name, rud.Type())
+	}
+	return exposeField(rf), nil
+}
+
+func exposeField(rf reflect.Value) reflect.Value {
+	if rf.CanAddr() {
+		rf = reflect.NewAt(rf.Type(), unsafe.Pointer(rf.UnsafeAddr())).Elem()
+	}
+	return rf
+}
+
+func lFieldGetByName(state *lua.LState) int {
+	ud := state.CheckUserData(1)
+	name := state.CheckString(2)
+
+	rf, err := fieldByName(userDataValue(ud), name)
+	if err != nil {
+		state.RaiseError(err.Error())
 	}
 
 	ret := newUserData(state, rf)
@@ -341,35 +763,28 @@ func lFieldGetByName(state *lua.LState) int {
 }
 
 func lFieldSetByName(state *lua.LState) int {
+	ctx := getContext(state)
 	ud := state.CheckUserData(1)
 	name := state.CheckString(2)
-	newVal := state.CheckUserData(3)
+	newVal := state.Get(3)
 
-	var rf reflect.Value
-	var rud reflect.Value
-	if r, ok := ud.Value.(reflect.Value); ok {
-		rud = r
-	} else {
-		rud = reflect.ValueOf(ud.Value)
-	}
-	if rud.Kind() == reflect.Ptr && rud.Elem().Kind() == reflect.Struct {
-		rs := rud.Elem()
-		rf = rs.FieldByName(name)
-		rf = reflect.NewAt(rf.Type(), unsafe.Pointer(rf.UnsafeAddr())).Elem()
-	} else if rud.Kind() == reflect.Struct {
-		rf = rud.FieldByName(name)
-	} else {
-		state.RaiseError("param1 need struct")
+	rud := userDataValue(ud)
+	rf, err := fieldByName(rud, name)
+	if err != nil {
+		state.RaiseError(err.Error())
 	}
 
-	if rf.Kind() == reflect.Ptr {
+	// pointer fields are written through unless the new value is a pointer itself
+	if rf.Kind() == reflect.Ptr && !rf.IsNil() && !assignableTo(newVal, rf.Type()) {
 		rf = rf.Elem()
 	}
-	if rn, ok := newVal.Value.(reflect.Value); ok {
-		rf.Set(rn)
-	} else {
-		rf.Set(reflect.ValueOf(newVal.Value))
+	rn, err := luaToValue(newVal, rf.Type())
+	if err != nil {
+		state.RaiseError(fmt.Sprintf("field:%s %s", name, err.Error()))
 	}
+	audit := ctx.auditWrite("field_set_by_name", rud.Type(), name, rf)
+	rf.Set(rn)
+	audit(rf)
 	return 0
 }
 
@@ -470,7 +885,7 @@ func lConvertTypeTo(state *lua.LState) int {
 
 func lMapGet(state *lua.LState) int {
 	m := state.CheckUserData(1)
-	k := state.CheckUserData(2)
+	k := state.Get(2)
 
 	rf, ok := m.Value.(reflect.Value)
 	if !ok {
@@ -481,10 +896,9 @@ func lMapGet(state *lua.LState) int {
 		state.RaiseError(fmt.Sprintf("field is %s need map type", rf.Type().Name()))
 	}
 
-	var krf reflect.Value
-	krf, ok = k.Value.(reflect.Value)
-	if !ok {
-		krf = reflect.ValueOf(k.Value)
+	krf, err := luaToValue(k, rf.Type().Key())
+	if err != nil {
+		state.RaiseError(fmt.Sprintf("param2 %s", err.Error()))
 	}
 
 	ret := rf.MapIndex(krf)
@@ -497,9 +911,10 @@ func lMapGet(state *lua.LState) int {
 }
 
 func lMapSet(state *lua.LState) int {
+	ctx := getContext(state)
 	m := state.CheckUserData(1)
-	k := state.CheckUserData(2)
-	v := state.CheckUserData(3)
+	k := state.Get(2)
+	v := state.Get(3)
 
 	rf, ok := m.Value.(reflect.Value)
 	if !ok {
@@ -510,23 +925,25 @@ func lMapSet(state *lua.LState) int {
 		state.RaiseError(fmt.Sprintf("field is %s need map type", rf.Type().Name()))
 	}
 
-	var krf reflect.Value
-	krf, ok = k.Value.(reflect.Value)
-	if !ok {
-		krf = reflect.ValueOf(k.Value)
+	krf, err := luaToValue(k, rf.Type().Key())
+	if err != nil {
+		state.RaiseError(fmt.Sprintf("param2 %s", err.Error()))
 	}
-
-	if vrf, ok := v.Value.(reflect.Value); ok {
-		rf.SetMapIndex(krf, vrf)
-	} else {
-		rf.SetMapIndex(krf, reflect.ValueOf(v.Value))
+	vrf, err := luaToValue(v, rf.Type().Elem())
+	if err != nil {
+		state.RaiseError(fmt.Sprintf("param3 %s", err.Error()))
 	}
+
+	audit := ctx.auditWrite("map_set", rf.Type(), formatValue(krf), rf.MapIndex(krf))
+	rf.SetMapIndex(krf, vrf)
+	audit(vrf)
 	return 0
 }
 
 func lMapDel(state *lua.LState) int {
+	ctx := getContext(state)
 	m := state.CheckUserData(1)
-	k := state.CheckUserData(2)
+	k := state.Get(2)
 
 	rf, ok := m.Value.(reflect.Value)
 	if !ok {
@@ -537,12 +954,13 @@ func lMapDel(state *lua.LState) int {
 		state.RaiseError(fmt.Sprintf("field is %s need map type", rf.Type().Name()))
 	}
 
-	var krf reflect.Value
-	krf, ok = k.Value.(reflect.Value)
-	if !ok {
-		krf = reflect.ValueOf(k.Value)
+	krf, err := luaToValue(k, rf.Type().Key())
+	if err != nil {
+		state.RaiseError(fmt.Sprintf("param2 %s", err.Error()))
 	}
+	audit := ctx.auditWrite("map_del", rf.Type(), formatValue(krf), rf.MapIndex(krf))
 	rf.SetMapIndex(krf, reflect.Value{})
+	audit(reflect.Value{})
 	return 0
 }
 
@@ -719,9 +1137,10 @@ func lArrayGet(state *lua.LState) int {
 }
 
 func lArraySet(state *lua.LState) int {
+	ctx := getContext(state)
 	m := state.CheckUserData(1)
 	i := state.CheckNumber(2)
-	new_v := state.CheckUserData(3)
+	new_v := state.Get(3)
 
 	rf, ok := m.Value.(reflect.Value)
 	if !ok {
@@ -733,11 +1152,13 @@ func lArraySet(state *lua.LState) int {
 	}
 
 	v := rf.Index(int(i))
-	if vrf, ok := new_v.Value.(reflect.Value); ok {
-		v.Set(vrf)
-	} else {
-		v.Set(reflect.ValueOf(new_v.Value))
+	vrf, err := luaToValue(new_v, v.Type())
+	if err != nil {
+		state.RaiseError(fmt.Sprintf("param3 %s", err.Error()))
 	}
+	audit := ctx.auditWrite("array_set", rf.Type(), fmt.Sprintf("[%d]", int(i)), v)
+	v.Set(vrf)
+	audit(v)
 
 	return 0
 }
@@ -762,6 +1183,7 @@ func lArraySlice(state *lua.LState) int {
 }
 
 func lSliceAppend(state *lua.LState) int {
+	ctx := getContext(state)
 	m := state.CheckUserData(1)
 	v := state.CheckUserData(2)
 
@@ -774,12 +1196,18 @@ func lSliceAppend(state *lua.LState) int {
 		state.RaiseError(fmt.Sprintf("field is %s need slice type", rf.Type().Name()))
 	}
 
-	var newSlice reflect.Value
-	if vrf, ok := v.Value.(reflect.Value); ok {
-		newSlice = reflect.Append(rf, vrf)
-	} else {
-		newSlice = reflect.Append(rf, reflect.ValueOf(v.Value))
+	elem, ok := v.Value.(reflect.Value)
+	if !ok {
+		elem = reflect.ValueOf(v.Value)
+	}
+	// with spare capacity the element is written into the backing array, which other slices may share
+	n := rf.Len()
+	audit := func(reflect.Value) {}
+	if n < rf.Cap() {
+		audit = ctx.auditWrite("slice_append", rf.Type(), fmt.Sprintf("[%d]", n), rf.Slice(0, n+1).Index(n))
 	}
+	newSlice := reflect.Append(rf, elem)
+	audit(newSlice.Index(n))
 
 	state.Push(newUserData(state, newSlice))
 	return 1
@@ -891,6 +1319,7 @@ func lNewWithName(state *lua.LState) int {
 
 	typeName := state.CheckString(1)
 	usePtr := state.CheckBool(2)
+	ctx.checkSymbol(state, "new_with_name", typeName)
 	t, err := ctx.dwarf.FindType(typeName)
 	if err != nil {
 		state.RaiseError(fmt.Sprintf("type:%s not found", typeName))
@@ -913,23 +1342,14 @@ func lNewInterface(state *lua.LState) int {
 	return 1
 }
 
+// lSearchTypeName(include [, opts]) returns the names and the count before paging, see searchOptions
 func lSearchTypeName(state *lua.LState) int {
 	ctx := getContext(state)
-	include := state.CheckString(1)
-
-	ret := &lua.LTable{}
-	err := ctx.dwarf.ForeachType(func(name string) {
-		if include == "" || strings.Index(name, include) >= 0 {
-			ret.Append(lua.LString(name))
-		}
-
-	})
+	idx, err := ctx.dwarf.Types()
 	if err != nil {
 		state.RaiseError(fmt.Sprintf("type search error:%s", err.Error()))
 	}
-
-	state.Push(ret)
-	return 1
+	return ctx.searchSymbols(state, "search_type_name", idx, false)
 }
 
 func lGetBoolean(state *lua.LState) int {
@@ -961,6 +1381,7 @@ func lGetBoolean(state *lua.LState) int {
 }
 
 func lSetBoolean(state *lua.LState) int {
+	ctx := getContext(state)
 	oldVal := state.CheckUserData(1)
 	newVal := state.CheckBool(2)
 
@@ -976,7 +1397,9 @@ func lSetBoolean(state *lua.LState) int {
 		state.RaiseError(fmt.Sprintf("field is %s need boolean type", ro.Type().Name()))
 	}
 
+	audit := ctx.auditWrite("set_boolean", ro.Type(), "", ro)
 	ro.SetBool(newVal)
+	audit(ro)
 	return 0
 }
 
@@ -1009,6 +1432,7 @@ func lGetString(state *lua.LState) int {
 }
 
 func lSetString(state *lua.LState) int {
+	ctx := getContext(state)
 	oldVal := state.CheckUserData(1)
 	newVal := state.CheckString(2)
 
@@ -1025,7 +1449,9 @@ func lSetString(state *lua.LState) int {
 		state.RaiseError(fmt.Sprintf("field is %s need string type", ro.Type().Name()))
 	}
 
+	audit := ctx.auditWrite("set_string", ro.Type(), "", ro)
 	ro.SetString(newVal)
+	audit(ro)
 	return 0
 }
 
@@ -1102,6 +1528,7 @@ func lGetNumber(state *lua.LState) int {
 }
 
 func lSetNumber(state *lua.LState) int {
+	ctx := getContext(state)
 	oldVal := state.CheckUserData(1)
 
 	ro, ok := oldVal.Value.(reflect.Value)
@@ -1112,6 +1539,7 @@ func lSetNumber(state *lua.LState) int {
 	if ro.Kind() == reflect.Ptr {
 		ro = ro.Elem()
 	}
+	audit := ctx.auditWrite("set_number", ro.Type(), "", ro)
 	switch ro.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		newVal := state.Get(2)
@@ -1149,10 +1577,12 @@ func lSetNumber(state *lua.LState) int {
 	default:
 		state.RaiseError(fmt.Sprintf("field is %s %s need number type", ro.Type(), ro.Kind()))
 	}
+	audit(ro)
 	return 0
 }
 
 func lSetAny(state *lua.LState) int {
+	ctx := getContext(state)
 	oldVal := state.CheckUserData(1)
 	newVal := state.CheckUserData(2)
 
@@ -1165,11 +1595,13 @@ func lSetAny(state *lua.LState) int {
 		ro = ro.Elem()
 	}
 
+	audit := ctx.auditWrite("set_any", ro.Type(), "", ro)
 	if rn, ok := newVal.Value.(reflect.Value); ok {
 		ro.Set(rn)
 	} else {
 		ro.Set(reflect.ValueOf(newVal.Value))
 	}
+	audit(ro)
 	return 0
 }
 
@@ -1194,6 +1626,7 @@ func lGetTypeWithName(state *lua.LState) int {
 
 	typeName := state.CheckString(1)
 	ptr := state.CheckBool(2)
+	ctx.checkSymbol(state, "get_type_with_name", typeName)
 	t, err := ctx.dwarf.FindType(typeName)
 	if err != nil {
 		state.RaiseError(fmt.Sprintf("type:%s not found", typeName))
@@ -1210,6 +1643,7 @@ func lGetTypeWithName(state *lua.LState) int {
 func lGetGlobalWithName(state *lua.LState) int {
 	ctx := getContext(state)
 	globalName := state.CheckString(1)
+	ctx.checkSymbol(state, "get_global_with_name", globalName)
 	global, err := ctx.dwarf.FindGlobal(globalName)
 	if err != nil || !global.IsValid() {
 		state.RaiseError(fmt.Sprintf("global:%s not found", globalName))
@@ -0,0 +1,172 @@
+package go_watch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type testRole struct {
+	ID    int
+	Name  string
+	Level int32
+	Items []int
+	Attrs map[string]int
+	Hook  func() string
+}
+
+func (r *testRole) SetName(name string) {
+	r.Name = name
+}
+
+func (r *testRole) Dangerous() string {
+	r.Level = -1
+	return "done"
+}
+
+// testOutput collects the print output of a state
+type testOutput struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (o *testOutput) print(session int, str string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lines = append(o.lines, str)
+}
+
+func (o *testOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return strings.Join(o.lines, "\n")
+}
+
+func newTestState(t *testing.T, role *testRole, opts ...Option) (*lua.LState, *testOutput) {
+	t.Helper()
+	out := &testOutput{}
+	state, err := NewLuaState(func(name string) interface{} { return role }, out.print, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(state.Close)
+	return state, out
+}
+
+// testScript prefixes script with the locals go_watch and role
+func testScript(script string) string {
+	return `local go_watch = require("go_watch") local role = go_watch.root_get("role") ` + script
+}
+
+func TestReadOnly(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		denied string // export in the PermissionError, empty when the script succeeds
+	}{
+		{name: "read field", script: `assert(go_watch.get_number(role.ID) == 7)`},
+		{name: "read by metatable", script: `assert(go_watch.get_string(role.Name) == "a" and #role.Items == 3)`},
+		{name: "read path", script: `assert(go_watch.get_number(go_watch.get_path(role, "Items[1]")) == 2)`},
+		{name: "to_json", script: `assert(go_watch.to_json(role) ~= "")`},
+		{name: "set_number", script: `go_watch.set_number(role.ID, 8)`, denied: "set_number"},
+		{name: "field_set_by_name", script: `go_watch.field_set_by_name(role, "ID", go_watch.new_int(8))`, denied: "field_set_by_name"},
+		{name: "set by metatable", script: `role.ID = 8`, denied: "set_path"},
+		{name: "set path", script: `go_watch.set_path(role, "Items[0]", 9)`, denied: "set_path"},
+		{name: "map_set", script: `go_watch.map_set(role.Attrs, "hp", 1)`, denied: "map_set"},
+		{name: "slice_append", script: `go_watch.slice_append(role.Items, 4)`, denied: "slice_append"},
+		{name: "call method", script: `role.SetName("x")`, denied: "call"},
+		{name: "call_func_with_name", script: `go_watch.call_func_with_name("strings.ToUpper", "x")`, denied: "call_func_with_name"},
+		{name: "global_set", script: `go_watch.global_set("os.Args", go_watch.new_interface())`, denied: "global_set"},
+		{name: "no os", script: `assert(os == nil and io == nil)`},
+		{name: "no files", script: `assert(dofile == nil and loadfile == nil)`},
+		{name: "no require of files", script: `assert(not pcall(require, "os"))`},
+		{name: "traceback only", script: `assert(debug.traceback and debug.getupvalue == nil)`},
+		{name: "string library", script: `assert(string.format("%d", 1) == "1" and table.concat({1, 2}) == "12")`},
+	}
+
+	for _, tt := range tests {
+		role := &testRole{ID: 7, Name: "a", Items: []int{1, 2, 3}, Attrs: map[string]int{}}
+		state, _ := newTestState(t, role, WithReadOnly())
+		err := Execute(state, testScript(tt.script), 1)
+		if tt.denied == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		var permissionErr *PermissionError
+		if !errors.As(err, &permissionErr) || permissionErr.Export != tt.denied {
+			t.Errorf("%s: error = %v, want permission error of %s", tt.name, err, tt.denied)
+		}
+		if role.ID != 7 || role.Name != "a" || len(role.Items) != 3 || role.Items[0] != 1 || len(role.Attrs) != 0 {
+			t.Errorf("%s: role changed to %+v", tt.name, role)
+		}
+	}
+}
+
+func TestDefaultStateLibs(t *testing.T) {
+	state, _ := newTestState(t, &testRole{})
+	if err := Execute(state, `assert(os.time and io.write and debug.getupvalue)`, 1); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExecuteWithResult(t *testing.T) {
+	tests := []struct {
+		script string
+		want   []interface{}
+	}{
+		{`return`, []interface{}{}},
+		{`return nil, true, 1.5, "a"`, []interface{}{nil, true, 1.5, "a"}},
+		{`return {1, 2}, {a = 1}, {}`, []interface{}{[]interface{}{float64(1), float64(2)}, map[string]interface{}{"a": float64(1)}, map[string]interface{}{}}},
+		{`return {1, nil, 3}`, []interface{}{map[string]interface{}{"1": float64(1), "3": float64(3)}}},
+		{`local t = {} t.self = t return t`, []interface{}{map[string]interface{}{"self": nil}}},
+		{`return role.ID, role.Items, {role.Name}`, []interface{}{7, []int{1}, []interface{}{"a"}}},
+		// unexported fields read by field_get_by_name can Interface
+		{`return go_watch.field_get_by_name(go_watch.root_get("hidden"), "n")`, []interface{}{3}},
+		{`return go_watch.field_get_by_name(go_watch.root_get("hidden"), "items")`, []interface{}{[]int{1, 2}}},
+	}
+
+	for _, tt := range tests {
+		role := &testRole{ID: 7, Name: "a", Items: []int{1}}
+		hidden := &struct {
+			n     int
+			items []int
+		}{3, []int{1, 2}}
+		state, err := NewLuaState(func(name string) interface{} {
+			if name == "hidden" {
+				return hidden
+			}
+			return role
+		}, func(int, string) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := ExecuteWithResult(state, testScript(tt.script), 1)
+		state.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.script, err)
+			continue
+		}
+		if !reflect.DeepEqual(results, tt.want) {
+			t.Errorf("%s: results = %#v, want %#v", tt.script, results, tt.want)
+		}
+	}
+}
+
+func TestLuaResultsOpaque(t *testing.T) {
+	state := lua.NewState()
+	defer state.Close()
+	ud := state.NewUserData()
+	ud.Value = reflect.ValueOf(struct{ items []int }{[]int{1, 2}}).Field(0)
+
+	results := luaResults([]lua.LValue{ud})
+	if want := []interface{}{json.RawMessage(`[1,2]`)}; !reflect.DeepEqual(results, want) {
+		t.Errorf("results = %#v, want %#v", results, want)
+	}
+}
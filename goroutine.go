@@ -0,0 +1,336 @@
+package go_watch
+
+import (
+	"bufio"
+	"bytes"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const maxStackBuf = 64 << 20
+
+type goroutineInfo struct {
+	id          int
+	state       string
+	waitReason  string
+	waitMinutes int
+	locked      bool
+	frames      []stackFrame
+	createdBy   *stackFrame
+}
+
+type stackFrame struct {
+	fn   string
+	file string
+	line int
+}
+
+// goroutineStatus are the states printed by the runtime, any other text in the header is a wait reason
+var goroutineStatus = map[string]bool{
+	"idle": true, "runnable": true, "running": true, "syscall": true,
+	"dead": true, "copystack": true, "preempted": true, "waiting": true,
+}
+
+// allGoroutines parses the text of runtime.Stack for all goroutines
+func allGoroutines() []*goroutineInfo {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxStackBuf {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+	return parseGoroutines(buf)
+}
+
+// parseGoroutines reads blocks like
+//
+//	goroutine 18 [chan receive, 5 minutes, locked to thread]:
+//	main.worker(0xc000010000)
+//		/app/main.go:20 +0x1d
+//	created by main.main in goroutine 1
+//		/app/main.go:12 +0x2a
+func parseGoroutines(buf []byte) []*goroutineInfo {
+	var list []*goroutineInfo
+	var g *goroutineInfo
+	var fn string
+	createdBy := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	scanner.Buffer(make([]byte, 64<<10), maxStackBuf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "goroutine "):
+			g = parseGoroutineHeader(line)
+			if g != nil {
+				list = append(list, g)
+			}
+			fn, createdBy = "", false
+		case g == nil || line == "":
+		case strings.HasPrefix(line, "\t"):
+			if fn == "" {
+				continue
+			}
+			frame := parseFrameLine(fn, line)
+			if createdBy {
+				g.createdBy = &frame
+			} else {
+				g.frames = append(g.frames, frame)
+			}
+			fn = ""
+		case strings.HasPrefix(line, "created by "):
+			fn, createdBy = strings.TrimPrefix(line, "created by "), true
+			if i := strings.Index(fn, " in goroutine "); i >= 0 {
+				fn = fn[:i]
+			}
+		case strings.HasPrefix(line, "..."):
+			// ...additional frames elided...
+		default:
+			// function name followed by its arguments
+			fn = line
+			if i := strings.LastIndexByte(fn, '('); i > 0 && strings.HasSuffix(fn, ")") {
+				fn = fn[:i]
+			}
+		}
+	}
+	return list
+}
+
+func parseGoroutineHeader(line string) *goroutineInfo {
+	start := strings.IndexByte(line, '[')
+	end := strings.LastIndexByte(line, ']')
+	if start < 0 || end < start {
+		return nil
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(line[len("goroutine "):start]))
+	if err != nil {
+		return nil
+	}
+
+	g := &goroutineInfo{id: id}
+	for i, part := range strings.Split(line[start+1:end], ", ") {
+		switch {
+		case i == 0 && goroutineStatus[part]:
+			g.state = part
+		case i == 0:
+			g.state, g.waitReason = "waiting", part
+		case part == "locked to thread":
+			g.locked = true
+		case strings.HasSuffix(part, " minutes"):
+			g.waitMinutes, _ = strconv.Atoi(strings.TrimSuffix(part, " minutes"))
+		}
+	}
+	return g
+}
+
+// parseFrameLine reads "\t/app/main.go:20 +0x1d"
+func parseFrameLine(fn string, line string) stackFrame {
+	frame := stackFrame{fn: fn, file: strings.TrimSpace(line)}
+	if i := strings.LastIndex(frame.file, " +0x"); i >= 0 {
+		frame.file = frame.file[:i]
+	}
+	if i := strings.LastIndexByte(frame.file, ':'); i >= 0 {
+		if n, err := strconv.Atoi(frame.file[i+1:]); err == nil {
+			frame.file, frame.line = frame.file[:i], n
+		}
+	}
+	return frame
+}
+
+// topFrame is the first frame outside the runtime, blocked goroutines all stop in runtime.gopark
+func (g *goroutineInfo) topFrame() string {
+	for _, frame := range g.frames {
+		if !strings.HasPrefix(frame.fn, "runtime.") {
+			return frame.fn
+		}
+	}
+	if len(g.frames) > 0 {
+		return g.frames[0].fn
+	}
+	return ""
+}
+
+// goroutineFilter is the argument of goroutines and goroutine_count, a string matches any frame or the wait reason,
+// a table is {func = "main.worker", state = "waiting", wait_reason = "chan receive", min_minutes = 1, limit = 10}
+type goroutineFilter struct {
+	text       string
+	fn         string
+	state      string
+	waitReason string
+	minMinutes int
+	limit      int
+}
+
+func checkGoroutineFilter(state *lua.LState) *goroutineFilter {
+	filter := &goroutineFilter{}
+	switch v := state.Get(1).(type) {
+	case lua.LString:
+		filter.text = string(v)
+	case *lua.LTable:
+		if s, ok := v.RawGetString("func").(lua.LString); ok {
+			filter.fn = string(s)
+		}
+		if s, ok := v.RawGetString("state").(lua.LString); ok {
+			filter.state = string(s)
+		}
+		if s, ok := v.RawGetString("wait_reason").(lua.LString); ok {
+			filter.waitReason = string(s)
+		}
+		if n, ok := v.RawGetString("min_minutes").(lua.LNumber); ok {
+			filter.minMinutes = int(n)
+		}
+		if n, ok := v.RawGetString("limit").(lua.LNumber); ok {
+			filter.limit = int(n)
+		}
+	case *lua.LNilType:
+	default:
+		state.ArgError(1, "need string or table")
+	}
+	return filter
+}
+
+func (filter *goroutineFilter) match(g *goroutineInfo) bool {
+	if filter.state != "" && g.state != filter.state {
+		return false
+	}
+	if filter.waitReason != "" && !strings.Contains(g.waitReason, filter.waitReason) {
+		return false
+	}
+	if g.waitMinutes < filter.minMinutes {
+		return false
+	}
+	if filter.fn != "" && !g.hasFrame(filter.fn) {
+		return false
+	}
+	if filter.text != "" && !g.hasFrame(filter.text) && !strings.Contains(g.waitReason, filter.text) {
+		return false
+	}
+	return true
+}
+
+func (g *goroutineInfo) hasFrame(fn string) bool {
+	for _, frame := range g.frames {
+		if strings.Contains(frame.fn, fn) {
+			return true
+		}
+	}
+	return false
+}
+
+func (frame *stackFrame) toTable(state *lua.LState) *lua.LTable {
+	tb := state.NewTable()
+	tb.RawSetString("func", lua.LString(frame.fn))
+	tb.RawSetString("file", lua.LString(frame.file))
+	tb.RawSetString("line", lua.LNumber(frame.line))
+	return tb
+}
+
+func (g *goroutineInfo) toTable(state *lua.LState) *lua.LTable {
+	tb := state.NewTable()
+	tb.RawSetString("id", lua.LNumber(g.id))
+	tb.RawSetString("state", lua.LString(g.state))
+	tb.RawSetString("wait_reason", lua.LString(g.waitReason))
+	tb.RawSetString("wait_minutes", lua.LNumber(g.waitMinutes))
+	tb.RawSetString("locked", lua.LBool(g.locked))
+	frames := state.NewTable()
+	for i := range g.frames {
+		frames.Append(g.frames[i].toTable(state))
+	}
+	tb.RawSetString("frames", frames)
+	if g.createdBy != nil {
+		tb.RawSetString("created_by", g.createdBy.toTable(state))
+	}
+	return tb
+}
+
+// lGoroutines(filter) returns {{id, state, wait_reason, wait_minutes, locked, frames = {{func, file, line}}, created_by}}
+// and the count of matched goroutines before limit
+func lGoroutines(state *lua.LState) int {
+	filter := checkGoroutineFilter(state)
+
+	ret := state.NewTable()
+	total := 0
+	for _, g := range allGoroutines() {
+		if !filter.match(g) {
+			continue
+		}
+		total++
+		if filter.limit <= 0 || total <= filter.limit {
+			ret.Append(g.toTable(state))
+		}
+	}
+
+	state.Push(ret)
+	state.Push(lua.LNumber(total))
+	return 2
+}
+
+// lGoroutineCount(filter) groups goroutines by the top frame outside the runtime, the most first:
+// {{func, count, states = {["chan receive"] = n}}} and the total
+func lGoroutineCount(state *lua.LState) int {
+	filter := checkGoroutineFilter(state)
+
+	type group struct {
+		fn     string
+		count  int
+		states map[string]int
+	}
+	groups := make(map[string]*group)
+	total := 0
+	for _, g := range allGoroutines() {
+		if !filter.match(g) {
+			continue
+		}
+		total++
+		fn := g.topFrame()
+		gr := groups[fn]
+		if gr == nil {
+			gr = &group{fn: fn, states: make(map[string]int)}
+			groups[fn] = gr
+		}
+		gr.count++
+		if g.waitReason != "" {
+			gr.states[g.waitReason]++
+		} else {
+			gr.states[g.state]++
+		}
+	}
+
+	list := make([]*group, 0, len(groups))
+	for _, gr := range groups {
+		list = append(list, gr)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].count != list[j].count {
+			return list[i].count > list[j].count
+		}
+		return list[i].fn < list[j].fn
+	})
+
+	ret := state.NewTable()
+	for i, gr := range list {
+		if filter.limit > 0 && i >= filter.limit {
+			break
+		}
+		tb := state.NewTable()
+		tb.RawSetString("func", lua.LString(gr.fn))
+		tb.RawSetString("count", lua.LNumber(gr.count))
+		states := state.NewTable()
+		for s, n := range gr.states {
+			states.RawSetString(s, lua.LNumber(n))
+		}
+		tb.RawSetString("states", states)
+		ret.Append(tb)
+	}
+
+	state.Push(ret)
+	state.Push(lua.LNumber(total))
+	return 2
+}
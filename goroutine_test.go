@@ -0,0 +1,102 @@
+package go_watch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGoroutineHeader(t *testing.T) {
+	tests := []struct {
+		line string
+		want *goroutineInfo
+	}{
+		{"goroutine 1 [running]:", &goroutineInfo{id: 1, state: "running"}},
+		{"goroutine 7 [runnable]:", &goroutineInfo{id: 7, state: "runnable"}},
+		{"goroutine 18 [chan receive]:", &goroutineInfo{id: 18, state: "waiting", waitReason: "chan receive"}},
+		{"goroutine 18 [chan receive, 5 minutes]:", &goroutineInfo{id: 18, state: "waiting", waitReason: "chan receive", waitMinutes: 5}},
+		{"goroutine 3 [syscall, locked to thread]:", &goroutineInfo{id: 3, state: "syscall", locked: true}},
+		{"goroutine 9 [select, 12 minutes, locked to thread]:", &goroutineInfo{id: 9, state: "waiting", waitReason: "select", waitMinutes: 12, locked: true}},
+		{"goroutine 4 [IO wait]:", &goroutineInfo{id: 4, state: "waiting", waitReason: "IO wait"}},
+		{"goroutine 5 [sync.Mutex.Lock]:", &goroutineInfo{id: 5, state: "waiting", waitReason: "sync.Mutex.Lock"}},
+		{"goroutine x [running]:", nil},
+		{"goroutine 1 running:", nil},
+	}
+
+	for _, tt := range tests {
+		if got := parseGoroutineHeader(tt.line); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseGoroutineHeader(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseGoroutines(t *testing.T) {
+	stack := `goroutine 1 [running]:
+main.main()
+	/app/main.go:10 +0x1d
+
+goroutine 18 [chan receive, 5 minutes]:
+main.(*Worker).run(0xc000010000, {0x4b2f60, 0x5})
+	/app/worker.go:20 +0x3c
+main.start.func1()
+	/app/main.go:30
+created by main.start in goroutine 1
+	/app/main.go:28 +0x2a
+
+goroutine 20 [select]:
+net/http.(*persistConn).writeLoop(0xc0000a2000)
+	/usr/local/go/src/net/http/transport.go:2421 +0xf1
+...additional frames elided...
+created by net/http.(*Transport).dialConn
+	/usr/local/go/src/net/http/transport.go:1777 +0x16f1
+`
+	want := []*goroutineInfo{
+		{
+			id: 1, state: "running",
+			frames: []stackFrame{{fn: "main.main", file: "/app/main.go", line: 10}},
+		},
+		{
+			id: 18, state: "waiting", waitReason: "chan receive", waitMinutes: 5,
+			frames: []stackFrame{
+				{fn: "main.(*Worker).run", file: "/app/worker.go", line: 20},
+				{fn: "main.start.func1", file: "/app/main.go", line: 30},
+			},
+			createdBy: &stackFrame{fn: "main.start", file: "/app/main.go", line: 28},
+		},
+		{
+			id: 20, state: "waiting", waitReason: "select",
+			frames: []stackFrame{
+				{fn: "net/http.(*persistConn).writeLoop", file: "/usr/local/go/src/net/http/transport.go", line: 2421},
+			},
+			createdBy: &stackFrame{fn: "net/http.(*Transport).dialConn", file: "/usr/local/go/src/net/http/transport.go", line: 1777},
+		},
+	}
+
+	got := parseGoroutines([]byte(stack))
+	if len(got) != len(want) {
+		t.Fatalf("parseGoroutines returned %d goroutines, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("goroutine %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestGoroutineTopFrame(t *testing.T) {
+	tests := []struct {
+		frames []stackFrame
+		want   string
+	}{
+		{nil, ""},
+		{[]stackFrame{{fn: "main.main"}}, "main.main"},
+		{[]stackFrame{{fn: "runtime.gopark"}, {fn: "runtime.chanrecv"}, {fn: "main.worker"}}, "main.worker"},
+		{[]stackFrame{{fn: "runtime.gopark"}, {fn: "runtime.main"}}, "runtime.gopark"},
+	}
+
+	for _, tt := range tests {
+		g := &goroutineInfo{frames: tt.frames}
+		if got := g.topFrame(); got != tt.want {
+			t.Errorf("topFrame(%v) = %q, want %q", tt.frames, got, tt.want)
+		}
+	}
+}
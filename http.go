@@ -0,0 +1,343 @@
+package go_watch
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lsg2020/gort"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	FormatText   = "text"
+	FormatNDJSON = "ndjson"
+)
+
+const defaultMaxScriptSize = 1 << 20
+
+type HTTPOptions struct {
+	Dwarf         *gort.DwarfRT // nil: debug info of the current executable, loaded on first use
+	Format        string        // default output format, FormatText or FormatNDJSON
+	MaxScriptSize int64         // max request body size, default 1MB
+	Timeout       time.Duration // max script execution time, 0 means no limit
+	StateOptions  []Option      // options for every lua state, e.g. WithReadOnly()
+	Trace         TraceFunc     // receives trace_func records, default log.Print, the response ends with the script
+	SwapError     SwapErrorFunc // receives errors of global_replace lua implementations, default log.Print
+	SessionTTL    time.Duration // a session keeps its lua state and globals until idle this long, default 10 minutes
+	MaxSessions   int           // max open sessions, default 16
+}
+
+const (
+	defaultSessionTTL  = 10 * time.Minute
+	defaultMaxSessions = 16
+)
+
+func discardPrint(session int, str string) {}
+
+type httpHandler struct {
+	root    RootFunc
+	opts    HTTPOptions
+	session int64 // numbers the states, for print and errors
+
+	dwarf *symbols
+
+	mu       sync.Mutex
+	sessions map[string]*httpSession
+	sweeping bool
+}
+
+// httpSession runs the scripts of a session one at a time on the same state
+type httpSession struct {
+	id       string // empty for the state of a single request, closed when it ends
+	num      int
+	mu       sync.Mutex
+	state    *lua.LState
+	busy     int // requests running or waiting, guarded by httpHandler.mu
+	lastUsed time.Time
+}
+
+type httpMessage struct {
+	Session string `json:"session,omitempty"`
+	Type    string `json:"type"`
+	Data    string `json:"data"`
+	Line    int    `json:"line,omitempty"` // script line of an error
+}
+
+// NewHTTPHandler returns a handler that executes the lua script posted in the request body,
+// print output is streamed back as chunked text or ndjson.
+// query params: session=new|<id> format=text|ndjson.
+// session=new opens a session and returns its id in the X-Go-Watch-Session header, later requests with the id
+// share its lua state. requests without session run on a new state closed when they end
+func NewHTTPHandler(root RootFunc, opts HTTPOptions) http.Handler {
+	if opts.Format == "" {
+		opts.Format = FormatText
+	}
+	if opts.MaxScriptSize <= 0 {
+		opts.MaxScriptSize = defaultMaxScriptSize
+	}
+	if opts.Trace == nil {
+		opts.Trace = func(record *TraceRecord) {
+			log.Print(record.String())
+		}
+	}
+	if opts.SwapError == nil {
+		opts.SwapError = func(session int, name string, err error) {
+			log.Printf("global:%s replacement error:%s", name, err.Error())
+		}
+	}
+	// WithTrace and WithSwapError in StateOptions win, scripts from the network never get io and os
+	opts.StateOptions = append(append([]Option{WithTrace(opts.Trace), WithSwapError(opts.SwapError)}, opts.StateOptions...), sandbox(), quietDeny(), keepEnv())
+	if opts.SessionTTL <= 0 {
+		opts.SessionTTL = defaultSessionTTL
+	}
+	if opts.MaxSessions <= 0 {
+		opts.MaxSessions = defaultMaxSessions
+	}
+	return &httpHandler{root: root, opts: opts, dwarf: newSymbols(opts.Dwarf), sessions: make(map[string]*httpSession)}
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	script, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, h.opts.MaxScriptSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("read script error:%s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		if strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+			format = FormatNDJSON
+		} else {
+			format = h.opts.Format
+		}
+	}
+	if format != FormatText && format != FormatNDJSON {
+		http.Error(w, fmt.Sprintf("format:%s not support", format), http.StatusBadRequest)
+		return
+	}
+
+	sess, status, err := h.acquire(r.URL.Query().Get("session"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer h.release(sess)
+
+	if format == FormatNDJSON {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	if sess.id != "" {
+		w.Header().Set("X-Go-Watch-Session", sess.id)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	out := newHTTPWriter(w, format, sess.id)
+	defer out.close()
+	state := sess.state
+	lookupContext(state).print = out.print
+
+	ctx := r.Context()
+	if h.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.opts.Timeout)
+		defer cancel()
+	}
+	if err := ExecuteContext(ctx, state, string(script), sess.num); err != nil {
+		out.writeError(err)
+	}
+}
+
+// acquire returns the session locked with the status for its error: a new state for an empty id,
+// a new kept session for "new", otherwise the open session of id
+func (h *httpHandler) acquire(id string) (*httpSession, int, error) {
+	if id == "" {
+		sess, err := h.newSession("")
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		sess.mu.Lock()
+		return sess, 0, nil
+	}
+
+	h.mu.Lock()
+	var sess *httpSession
+	if id == "new" {
+		if len(h.sessions) >= h.opts.MaxSessions {
+			h.mu.Unlock()
+			return nil, http.StatusServiceUnavailable, fmt.Errorf("too many sessions, max %d", h.opts.MaxSessions)
+		}
+		var err error
+		if id, err = newSessionID(); err == nil {
+			sess, err = h.newSession(id)
+		}
+		if err != nil {
+			h.mu.Unlock()
+			return nil, http.StatusInternalServerError, err
+		}
+		h.sessions[id] = sess
+		if !h.sweeping {
+			h.sweeping = true
+			time.AfterFunc(h.opts.SessionTTL, h.sweep)
+		}
+	} else if sess = h.sessions[id]; sess == nil {
+		h.mu.Unlock()
+		return nil, http.StatusNotFound, fmt.Errorf("session:%s not found", id)
+	}
+	sess.busy++
+	h.mu.Unlock()
+
+	sess.mu.Lock()
+	return sess, 0, nil
+}
+
+func (h *httpHandler) newSession(id string) (*httpSession, error) {
+	state, err := newLuaState(h.root, discardPrint, h.dwarf, h.opts.StateOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return &httpSession{id: id, num: int(atomic.AddInt64(&h.session, 1)), state: state}, nil
+}
+
+// newSessionID returns a random id, ids can not be guessed to run scripts in the session of others
+func newSessionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (h *httpHandler) release(sess *httpSession) {
+	// output of the finished request is dropped, e.g. print of functions replaced by the script
+	lookupContext(sess.state).print = discardPrint
+	sess.mu.Unlock()
+	if sess.id == "" {
+		sess.state.Close()
+		return
+	}
+
+	h.mu.Lock()
+	sess.busy--
+	sess.lastUsed = time.Now()
+	h.mu.Unlock()
+}
+
+// sweep closes the states of sessions idle longer than SessionTTL, it runs while any session is open
+func (h *httpHandler) sweep() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, sess := range h.sessions {
+		if sess.busy == 0 && time.Since(sess.lastUsed) >= h.opts.SessionTTL {
+			sess.state.Close()
+			delete(h.sessions, id)
+		}
+	}
+	if len(h.sessions) > 0 {
+		time.AfterFunc(h.opts.SessionTTL/2, h.sweep)
+	} else {
+		h.sweeping = false
+	}
+}
+
+// httpWriter sends the status code with the first output, so a script failing before any print gets an error status
+type httpWriter struct {
+	w           http.ResponseWriter
+	flusher     http.Flusher
+	format      string
+	session     string
+	mu          sync.Mutex
+	wroteHeader bool
+	closed      bool
+}
+
+func newHTTPWriter(w http.ResponseWriter, format string, session string) *httpWriter {
+	flusher, _ := w.(http.Flusher)
+	return &httpWriter{w: w, flusher: flusher, format: format, session: session}
+}
+
+func (o *httpWriter) print(session int, str string) {
+	o.write(http.StatusOK, &httpMessage{Session: o.session, Type: "print", Data: str})
+}
+
+func (o *httpWriter) writeError(err error) {
+	msg := &httpMessage{Session: o.session, Type: "error", Data: err.Error()}
+	var scriptErr *ScriptError
+	if errors.As(err, &scriptErr) {
+		msg.Line = scriptErr.Line
+	}
+	o.write(httpStatus(err), msg)
+}
+
+func httpStatus(err error) int {
+	var permissionErr *PermissionError
+	var timeoutErr *TimeoutError
+	var panicErr *PanicError
+	var scriptErr *ScriptError
+	switch {
+	case errors.As(err, &permissionErr):
+		return http.StatusForbidden
+	case errors.As(err, &timeoutErr):
+		// the script ran too long, or the request was canceled while it ran
+		if timeoutErr.Timeout() {
+			return http.StatusGatewayTimeout
+		}
+		return http.StatusServiceUnavailable
+	case errors.As(err, &panicErr):
+		return http.StatusInternalServerError
+	case errors.As(err, &scriptErr):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// close drops later output, functions replaced by global_replace keep printing after the request
+func (o *httpWriter) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+}
+
+func (o *httpWriter) write(status int, msg *httpMessage) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return
+	}
+
+	if !o.wroteHeader {
+		o.wroteHeader = true
+		o.w.WriteHeader(status)
+	}
+	if o.format == FormatNDJSON {
+		data, _ := json.Marshal(msg)
+		o.w.Write(append(data, '\n'))
+	} else if msg.Type == "print" {
+		fmt.Fprintln(o.w, msg.Data)
+	} else {
+		fmt.Fprintf(o.w, "%s: %s\n", msg.Type, msg.Data)
+	}
+	if o.flusher != nil {
+		o.flusher.Flush()
+	}
+}
@@ -0,0 +1,178 @@
+package go_watch
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHandler(role *testRole, opts HTTPOptions) http.Handler {
+	return NewHTTPHandler(func(name string) interface{} { return role }, opts)
+}
+
+// post runs script on h and returns the response and its ndjson messages
+func post(t *testing.T, h http.Handler, query string, script string) (*httptest.ResponseRecorder, []httpMessage) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/debug/go_watch?format=ndjson&"+query, strings.NewReader(script))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	// errors before the script runs are plain text
+	if w.Header().Get("Content-Type") != "application/x-ndjson" {
+		return w, nil
+	}
+	var msgs []httpMessage
+	scanner := bufio.NewScanner(strings.NewReader(w.Body.String()))
+	for scanner.Scan() {
+		var msg httpMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			t.Fatalf("bad ndjson line %q: %v", scanner.Text(), err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return w, msgs
+}
+
+func TestHTTPStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   HTTPOptions
+		script string
+		status int
+		msgs   []httpMessage // Session is ignored, Data of errors only needs to contain the wanted Data
+	}{
+		{
+			name:   "print",
+			script: `print("hello", 1)`,
+			status: http.StatusOK,
+			msgs:   []httpMessage{{Type: "print", Data: "hello\t1"}},
+		},
+		{
+			name:   "script error",
+			script: "local a = 1\nerror('boom')",
+			status: http.StatusBadRequest,
+			msgs:   []httpMessage{{Type: "error", Data: "boom", Line: 2}},
+		},
+		{
+			name:   "syntax error",
+			script: "local a = = 1",
+			status: http.StatusBadRequest,
+			msgs:   []httpMessage{{Type: "error", Data: "syntax error", Line: 1}},
+		},
+		{
+			name:   "error after print",
+			script: "print('a')\nerror('boom')",
+			status: http.StatusOK,
+			msgs:   []httpMessage{{Type: "print", Data: "a"}, {Type: "error", Data: "boom", Line: 2}},
+		},
+		{
+			name:   "permission",
+			opts:   HTTPOptions{StateOptions: []Option{WithReadOnly()}},
+			script: testScript(`go_watch.set_number(role.ID, 8)`),
+			status: http.StatusForbidden,
+			msgs:   []httpMessage{{Type: "error", Data: "permission denied: set_number", Line: 1}},
+		},
+		{
+			name:   "go panic",
+			script: testScript(`go_watch.get_len(go_watch.new_int(1))`),
+			status: http.StatusInternalServerError,
+			msgs:   []httpMessage{{Type: "error", Data: "go panic", Line: 1}},
+		},
+		{
+			name:   "timeout",
+			opts:   HTTPOptions{Timeout: 50 * time.Millisecond},
+			script: `while true do end`,
+			status: http.StatusGatewayTimeout,
+			msgs:   []httpMessage{{Type: "error", Data: "script interrupted:context deadline exceeded"}},
+		},
+		{
+			name:   "no os",
+			script: `os.exit(1)`,
+			status: http.StatusBadRequest,
+			msgs:   []httpMessage{{Type: "error", Data: "attempt to index a non-table object(nil) with key 'exit'", Line: 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		role := &testRole{ID: 7}
+		w, msgs := post(t, newTestHandler(role, tt.opts), "", tt.script)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if len(msgs) != len(tt.msgs) {
+			t.Errorf("%s: messages = %+v, want %+v", tt.name, msgs, tt.msgs)
+			continue
+		}
+		for i, want := range tt.msgs {
+			got := msgs[i]
+			if got.Type != want.Type || got.Line != want.Line ||
+				(want.Type == "print" && got.Data != want.Data) || !strings.Contains(got.Data, want.Data) {
+				t.Errorf("%s: message %d = %+v, want %+v", tt.name, i, got, want)
+			}
+		}
+		if role.ID != 7 {
+			t.Errorf("%s: ID changed to %d", tt.name, role.ID)
+		}
+	}
+}
+
+func TestHTTPRequest(t *testing.T) {
+	h := newTestHandler(&testRole{}, HTTPOptions{MaxScriptSize: 16})
+	tests := []struct {
+		method string
+		query  string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "format=xml", "print(1)", http.StatusBadRequest},
+		{http.MethodPost, "", strings.Repeat(" ", 17), http.StatusBadRequest},
+		{http.MethodPost, "format=text", "print(1)", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/debug/go_watch?"+tt.query, strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s ?%s: status = %d, want %d", tt.method, tt.query, w.Code, tt.status)
+		}
+	}
+}
+
+func TestHTTPSession(t *testing.T) {
+	h := newTestHandler(&testRole{}, HTTPOptions{MaxSessions: 1})
+
+	// without session every request runs on a new state, closed when it ends
+	w, _ := post(t, h, "", `x = 1`)
+	if w.Code != http.StatusOK || w.Header().Get("X-Go-Watch-Session") != "" {
+		t.Errorf("status = %d session = %q, want 200 and no session", w.Code, w.Header().Get("X-Go-Watch-Session"))
+	}
+	if w, msgs := post(t, h, "", `print(x)`); w.Code != http.StatusOK || len(msgs) != 1 || msgs[0].Data != "nil" {
+		t.Errorf("status = %d messages = %+v, want nil", w.Code, msgs)
+	}
+
+	w, _ = post(t, h, "session=new", `x = 1`)
+	id := w.Header().Get("X-Go-Watch-Session")
+	if w.Code != http.StatusOK || len(id) != 32 {
+		t.Fatalf("status = %d session = %q, want 200 and a random id", w.Code, id)
+	}
+	w, msgs := post(t, h, "session="+id, `print(x)`)
+	if w.Code != http.StatusOK || len(msgs) != 1 || msgs[0].Data != "1" || msgs[0].Session != id {
+		t.Errorf("status = %d messages = %+v, want 1 in session %s", w.Code, msgs, id)
+	}
+
+	if w, _ := post(t, h, "session=1", `print(x)`); w.Code != http.StatusNotFound {
+		t.Errorf("unknown session status = %d, want 404", w.Code)
+	}
+	if w, _ := post(t, h, "session=new", `print(x)`); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("session over max status = %d, want 503", w.Code)
+	}
+	if n := len(h.(*httpHandler).sessions); n != 1 {
+		t.Errorf("sessions = %d, want 1", n)
+	}
+}
@@ -0,0 +1,293 @@
+package go_watch
+
+import (
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	defaultInstanceLimit = 100
+	maxInstanceNodes     = 1000000
+)
+
+// globals of these packages are not walked even when asked, they hold the state of go-watch itself
+var skipInstancePackages = []string{
+	"github.com/lsg2020/go-watch", "github.com/lsg2020/gort", "github.com/go-delve/delve", "github.com/yuin/gopher-lua",
+}
+
+// mainModule is the module path of the executable, its packages are walked by default
+var mainModule = func() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Path
+	}
+	return ""
+}()
+
+func skipInstancePackage(pkg string) bool {
+	for _, skip := range skipInstancePackages {
+		if underPackage(pkg, skip) {
+			return true
+		}
+	}
+	return false
+}
+
+func underPackage(pkg string, prefix string) bool {
+	return prefix != "" && (pkg == prefix || strings.HasPrefix(pkg, prefix+"/"))
+}
+
+// stdPackage reports whether pkg is in the standard library, its paths have no dot in the first element
+func stdPackage(pkg string) bool {
+	return !strings.Contains(strings.SplitN(pkg, "/", 2)[0], ".")
+}
+
+// walkInstancePackage reports whether find_instances walks the globals of pkg: packages under one of prefixes,
+// or main and the main module when no prefix is given. maps of other packages, like the standard library,
+// are written by their own goroutines under locks the walk does not take, and that is a fatal error
+func walkInstancePackage(pkg string, prefixes []string, mainModule string) bool {
+	if pkg == "" || skipInstancePackage(pkg) {
+		return false
+	}
+	own := pkg == "main" || underPackage(pkg, mainModule)
+	if !own && stdPackage(pkg) {
+		return false
+	}
+	if len(prefixes) == 0 {
+		return own
+	}
+	for _, prefix := range prefixes {
+		if underPackage(pkg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type instance struct {
+	value reflect.Value
+	path  string
+}
+
+// instanceWalker follows pointers, interfaces, structs, arrays, slices and maps, each pointer, slice and map once
+type instanceWalker struct {
+	target  reflect.Type
+	limit   int
+	nodes   int
+	found   []instance
+	visited map[pointerKey]bool
+	reach   map[reflect.Type]bool
+}
+
+func (w *instanceWalker) done() bool {
+	return len(w.found) >= w.limit || w.nodes >= maxInstanceNodes
+}
+
+// mayReach reports whether a value of t can lead to the target, interfaces and unsafe pointers may hold anything
+func (w *instanceWalker) mayReach(t reflect.Type) bool {
+	r, _ := w.reachable(t, make(map[reflect.Type]bool))
+	return r
+}
+
+// reachable does not cache false while it depends on a type still being resolved up the recursion
+func (w *instanceWalker) reachable(t reflect.Type, pending map[reflect.Type]bool) (r bool, incomplete bool) {
+	if t == w.target {
+		return true, false
+	}
+	if r, ok := w.reach[t]; ok {
+		return r, false
+	}
+	if pending[t] {
+		return false, true
+	}
+	pending[t] = true
+	defer delete(pending, t)
+
+	var children []reflect.Type
+	switch t.Kind() {
+	case reflect.Interface, reflect.UnsafePointer:
+		r = true
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		children = append(children, t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			children = append(children, t.Field(i).Type)
+		}
+	}
+	for _, child := range children {
+		cr, ci := w.reachable(child, pending)
+		r, incomplete = r || cr, incomplete || ci
+		if r {
+			break
+		}
+	}
+	if r || !incomplete || len(pending) == 1 {
+		w.reach[t] = r
+	}
+	return r, incomplete
+}
+
+func (w *instanceWalker) walk(v reflect.Value, path string) {
+	if w.done() || !v.IsValid() || !w.mayReach(v.Type()) {
+		return
+	}
+	w.nodes++
+	v = exposeField(v)
+	if v.Type() == w.target {
+		w.found = append(w.found, instance{value: v, path: path})
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || w.visit(v) {
+			return
+		}
+		w.walk(v.Elem(), path)
+	case reflect.Interface:
+		if !v.IsNil() {
+			w.walk(v.Elem(), path)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			w.walk(v.Field(i), path+"."+v.Type().Field(i).Name)
+		}
+	case reflect.Slice:
+		if v.IsNil() || w.visit(v) {
+			return
+		}
+		fallthrough
+	case reflect.Array:
+		for i := 0; i < v.Len() && !w.done(); i++ {
+			w.walk(v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Map:
+		if v.IsNil() || w.visit(v) {
+			return
+		}
+		iter := v.MapRange()
+		for iter.Next() && !w.done() {
+			w.walk(iter.Value(), fmt.Sprintf("%s[%s]", path, formatKey(iter.Key())))
+		}
+	}
+}
+
+// visit marks pointers, slices and maps, it reports whether v was seen
+func (w *instanceWalker) visit(v reflect.Value) bool {
+	key := pointerKey{v.Pointer(), v.Type()}
+	if w.visited[key] {
+		return true
+	}
+	w.visited[key] = true
+	return false
+}
+
+func formatKey(key reflect.Value) string {
+	switch key.Kind() {
+	case reflect.String:
+		return fmt.Sprintf("%q", key.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Bool:
+		return fmt.Sprint(key)
+	default:
+		return formatValue(key)
+	}
+}
+
+// lFindInstances(t, limit, roots, packages) walks the roots then the globals of packages and returns the values of type t
+// with their path, {{value, path}}, and whether the walk stopped at limit or the node budget.
+// t is a type name, a Type or a value, roots are root names or values, packages are import paths,
+// the packages of the main module when omitted and none when empty, see walkInstancePackage
+func lFindInstances(state *lua.LState) int {
+	ctx := getContext(state)
+
+	var target reflect.Type
+	switch v := state.Get(1).(type) {
+	case lua.LString:
+		ctx.checkSymbol(state, "find_instances", string(v))
+		var err error
+		if target, err = ctx.dwarf.FindType(string(v)); err != nil {
+			state.RaiseError(fmt.Sprintf("type:%s not found", string(v)))
+		}
+	case *lua.LUserData:
+		if typ, ok := v.Value.(reflect.Type); ok {
+			target = typ
+		} else if rv := userDataValue(v); rv.IsValid() {
+			target = rv.Type()
+		}
+	}
+	if target == nil {
+		state.ArgError(1, "need type name, type or value")
+	}
+
+	w := &instanceWalker{
+		target:  target,
+		limit:   state.OptInt(2, defaultInstanceLimit),
+		visited: make(map[pointerKey]bool),
+		reach:   make(map[reflect.Type]bool),
+	}
+	if w.limit <= 0 {
+		w.limit = defaultInstanceLimit
+	}
+
+	if roots := state.OptTable(3, nil); roots != nil {
+		roots.ForEach(func(k lua.LValue, v lua.LValue) {
+			switch root := v.(type) {
+			case lua.LString:
+				w.walk(reflect.ValueOf(ctx.root(string(root))), string(root))
+			case *lua.LUserData:
+				w.walk(userDataValue(root), fmt.Sprintf("roots[%s]", k.String()))
+			}
+		})
+	}
+
+	var packages []string
+	rootsOnly := false
+	if tb := state.OptTable(4, nil); tb != nil {
+		tb.ForEach(func(k lua.LValue, v lua.LValue) {
+			if pkg, ok := v.(lua.LString); ok {
+				packages = append(packages, string(pkg))
+			}
+		})
+		// an empty list walks the roots only
+		rootsOnly = len(packages) == 0
+	}
+
+	if !rootsOnly {
+		walkGlobals(state, ctx, w, packages)
+	}
+
+	ret := state.NewTable()
+	for _, inst := range w.found {
+		tb := state.NewTable()
+		tb.RawSetString("value", newUserData(state, inst.value))
+		tb.RawSetString("path", lua.LString(inst.path))
+		ret.Append(tb)
+	}
+	state.Push(ret)
+	state.Push(lua.LBool(w.done()))
+	return 2
+}
+
+func walkGlobals(state *lua.LState, ctx *Context, w *instanceWalker, packages []string) {
+	globals, err := ctx.dwarf.Globals()
+	if err != nil {
+		state.RaiseError(err.Error())
+	}
+	for _, name := range globals.Names() {
+		if w.done() {
+			break
+		}
+		if !walkInstancePackage(packageOf(name), packages, mainModule) || !ctx.allowSymbol("find_instances", name) {
+			continue
+		}
+		// globals removed by the linker are not found
+		global, err := ctx.dwarf.FindGlobal(name)
+		if err != nil {
+			continue
+		}
+		w.walk(global, name)
+	}
+}
@@ -0,0 +1,84 @@
+package go_watch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWalkInstancePackage(t *testing.T) {
+	const mainModule = "example.com/app"
+	tests := []struct {
+		pkg      string
+		prefixes []string
+		want     bool
+	}{
+		{"main", nil, true},
+		{"example.com/app", nil, true},
+		{"example.com/app/role", nil, true},
+		{"example.com/application", nil, false},
+		{"github.com/a/b", nil, false},
+		{"net/http", nil, false},
+		{"expvar", nil, false},
+		{"runtime", nil, false},
+		{"", nil, false},
+		{"github.com/a/b", []string{"github.com/a"}, true},
+		{"github.com/a/b/c", []string{"github.com/a/b"}, true},
+		{"github.com/a/bc", []string{"github.com/a/b"}, false},
+		{"example.com/app/role", []string{"github.com/a"}, false},
+		{"example.com/app/role", []string{"example.com/app/role"}, true},
+		// the standard library is never walked
+		{"net/http", []string{"net/http"}, false},
+		{"sync", []string{"sync"}, false},
+		// nor the packages of go-watch
+		{"github.com/yuin/gopher-lua", []string{"github.com/yuin"}, false},
+		{"github.com/lsg2020/go-watch", []string{"github.com/lsg2020/go-watch"}, false},
+		// an empty prefix matches nothing
+		{"example.com/app", []string{""}, false},
+	}
+
+	for _, tt := range tests {
+		if got := walkInstancePackage(tt.pkg, tt.prefixes, mainModule); got != tt.want {
+			t.Errorf("walkInstancePackage(%q, %q) = %v, want %v", tt.pkg, tt.prefixes, got, tt.want)
+		}
+	}
+
+	// modules without a dot in their path are not the standard library
+	if !walkInstancePackage("app/role", nil, "app") {
+		t.Error("walkInstancePackage(app/role) of module app = false, want true")
+	}
+}
+
+func TestFindInstances(t *testing.T) {
+	other := &testRole{ID: 2}
+	role := &testRole{ID: 1, Attrs: map[string]int{}}
+	type holder struct {
+		Roles map[int]*testRole
+		List  []interface{}
+	}
+	h := &holder{Roles: map[int]*testRole{2: other}, List: []interface{}{role, other}}
+
+	state, out := newTestState(t, role)
+	lookupContext(state).root = func(name string) interface{} {
+		if name == "holder" {
+			return h
+		}
+		return role
+	}
+	err := Execute(state, testScript(`
+		local list, truncated = go_watch.find_instances(role, 10, {"holder"}, {})
+		assert(not truncated)
+		for _, inst in ipairs(list) do
+			print(inst.path, go_watch.get_number(inst.value.ID))
+		end
+		local list, truncated = go_watch.find_instances(role, 1, {"holder"}, {})
+		assert(#list == 1 and truncated)
+	`), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a value is found once for each path to it
+	want := []string{"holder.Roles[2]\t2", "holder.List[0]\t1", "holder.List[1]\t2"}
+	if got := out.String(); got != strings.Join(want, "\n") {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
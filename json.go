@@ -0,0 +1,285 @@
+package go_watch
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	defaultJSONMaxDepth = 16
+	defaultJSONMaxElems = 1000
+)
+
+type jsonOptions struct {
+	maxDepth int
+	maxElems int
+	indent   string
+}
+
+// jsonEncoder writes any reflect.Value as json, unexported fields are read by kind so no Interface call is needed.
+// markers: {"$cycle":type} {"$max_depth":type} {"$truncated":count}
+type jsonEncoder struct {
+	buf      bytes.Buffer
+	opts     jsonOptions
+	visiting map[pointerKey]bool
+}
+
+func toJSON(v reflect.Value, opts jsonOptions) (string, error) {
+	if opts.maxElems < 0 {
+		opts.maxElems = 0
+	}
+	e := &jsonEncoder{opts: opts, visiting: make(map[pointerKey]bool)}
+	e.encode(v, 0)
+	if opts.indent == "" {
+		return e.buf.String(), nil
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, e.buf.Bytes(), "", opts.indent); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+func (e *jsonEncoder) encode(v reflect.Value, depth int) {
+	if !v.IsValid() {
+		e.buf.WriteString("null")
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		e.buf.WriteString(strconv.FormatBool(v.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.buf.WriteString(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			e.writeString(strconv.FormatFloat(f, 'g', -1, 64))
+		} else {
+			e.buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Interface:
+		if v.IsNil() {
+			e.buf.WriteString("null")
+			return
+		}
+		e.encode(v.Elem(), depth)
+	case reflect.Ptr:
+		if v.IsNil() {
+			e.buf.WriteString("null")
+			return
+		}
+		key := pointerKey{v.Pointer(), v.Type()}
+		if e.visiting[key] {
+			e.writeMarker("$cycle", v.Type().String())
+			return
+		}
+		e.visiting[key] = true
+		e.encode(v.Elem(), depth)
+		delete(e.visiting, key)
+	case reflect.Struct:
+		if depth >= e.opts.maxDepth {
+			e.writeMarker("$max_depth", v.Type().String())
+			return
+		}
+		e.buf.WriteByte('{')
+		for i := 0; i < v.NumField(); i++ {
+			if i > 0 {
+				e.buf.WriteByte(',')
+			}
+			e.writeString(v.Type().Field(i).Name)
+			e.buf.WriteByte(':')
+			e.encode(v.Field(i), depth+1)
+		}
+		e.buf.WriteByte('}')
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf.WriteString("null")
+			return
+		}
+		if depth >= e.opts.maxDepth {
+			e.writeMarker("$max_depth", v.Type().String())
+			return
+		}
+		key := pointerKey{v.Pointer(), v.Type()}
+		if e.visiting[key] {
+			e.writeMarker("$cycle", v.Type().String())
+			return
+		}
+		e.visiting[key] = true
+		e.encodeMap(v, depth)
+		delete(e.visiting, key)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			e.buf.WriteString("null")
+			return
+		}
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			e.writeString(string(v.Bytes()))
+			return
+		}
+		if depth >= e.opts.maxDepth {
+			e.writeMarker("$max_depth", v.Type().String())
+			return
+		}
+		e.buf.WriteByte('[')
+		n := v.Len()
+		for i := 0; i < n && i < e.opts.maxElems; i++ {
+			if i > 0 {
+				e.buf.WriteByte(',')
+			}
+			e.encode(v.Index(i), depth+1)
+		}
+		if n > e.opts.maxElems {
+			if e.opts.maxElems > 0 {
+				e.buf.WriteByte(',')
+			}
+			e.writeTruncated(n - e.opts.maxElems)
+		}
+		e.buf.WriteByte(']')
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		if v.IsNil() {
+			e.buf.WriteString("null")
+			return
+		}
+		e.writeString(formatValue(v))
+	default:
+		e.writeString(formatValue(v))
+	}
+}
+
+func (e *jsonEncoder) encodeMap(v reflect.Value, depth int) {
+	type entry struct {
+		key string
+		val reflect.Value
+	}
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		entries = append(entries, entry{key: mapKeyString(iter.Key()), val: iter.Value()})
+	}
+	// sorted keys keep dumps diffable
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	e.buf.WriteByte('{')
+	for i, en := range entries {
+		if i > 0 {
+			e.buf.WriteByte(',')
+		}
+		if i >= e.opts.maxElems {
+			e.writeString("$truncated")
+			e.buf.WriteByte(':')
+			e.buf.WriteString(strconv.Itoa(len(entries) - e.opts.maxElems))
+			break
+		}
+		e.writeString(en.key)
+		e.buf.WriteByte(':')
+		e.encode(en.val, depth+1)
+	}
+	e.buf.WriteByte('}')
+}
+
+func mapKeyString(k reflect.Value) string {
+	for k.Kind() == reflect.Interface && !k.IsNil() {
+		k = k.Elem()
+	}
+	switch k.Kind() {
+	case reflect.String:
+		return k.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10)
+	case reflect.Bool:
+		return strconv.FormatBool(k.Bool())
+	default:
+		return formatValue(k)
+	}
+}
+
+func (e *jsonEncoder) writeMarker(name string, typ string) {
+	e.buf.WriteByte('{')
+	e.writeString(name)
+	e.buf.WriteByte(':')
+	e.writeString(typ)
+	e.buf.WriteByte('}')
+}
+
+func (e *jsonEncoder) writeTruncated(count int) {
+	e.buf.WriteString(`{"$truncated":`)
+	e.buf.WriteString(strconv.Itoa(count))
+	e.buf.WriteByte('}')
+}
+
+func (e *jsonEncoder) writeString(s string) {
+	const hex = "0123456789abcdef"
+	e.buf.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				e.buf.WriteByte('\\')
+				e.buf.WriteByte(c)
+			case c == '\n':
+				e.buf.WriteString(`\n`)
+			case c == '\r':
+				e.buf.WriteString(`\r`)
+			case c == '\t':
+				e.buf.WriteString(`\t`)
+			case c < 0x20:
+				e.buf.WriteString(`\u00`)
+				e.buf.WriteByte(hex[c>>4])
+				e.buf.WriteByte(hex[c&0xf])
+			default:
+				e.buf.WriteByte(c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			e.buf.WriteString("\ufffd")
+		} else {
+			e.buf.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	e.buf.WriteByte('"')
+}
+
+func lToJSON(state *lua.LState) int {
+	ud := state.CheckUserData(1)
+	opts := jsonOptions{maxDepth: defaultJSONMaxDepth, maxElems: defaultJSONMaxElems}
+	if tb := state.OptTable(2, nil); tb != nil {
+		if n, ok := tb.RawGetString("max_depth").(lua.LNumber); ok {
+			opts.maxDepth = int(n)
+		}
+		if n, ok := tb.RawGetString("max_elems").(lua.LNumber); ok {
+			opts.maxElems = int(n)
+		}
+		if s, ok := tb.RawGetString("indent").(lua.LString); ok {
+			opts.indent = string(s)
+		}
+	}
+
+	str, err := toJSON(userDataValue(ud), opts)
+	if err != nil {
+		state.RaiseError(err.Error())
+	}
+	state.Push(lua.LString(str))
+	return 1
+}
@@ -0,0 +1,69 @@
+package go_watch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestToJSON(t *testing.T) {
+	type node struct {
+		Name string
+		Next *node
+	}
+	cycle := &node{Name: "a"}
+	cycle.Next = cycle
+
+	tests := []struct {
+		name string
+		v    interface{}
+		opts jsonOptions
+		want string
+	}{
+		{name: "slice", v: []int{1, 2, 3}, opts: jsonOptions{maxDepth: 4, maxElems: 10}, want: `[1,2,3]`},
+		{name: "slice truncated", v: []int{1, 2, 3}, opts: jsonOptions{maxDepth: 4, maxElems: 2}, want: `[1,2,{"$truncated":1}]`},
+		{name: "slice max_elems 0", v: []int{1, 2}, opts: jsonOptions{maxDepth: 4}, want: `[{"$truncated":2}]`},
+		{name: "slice max_elems < 0", v: []int{1, 2}, opts: jsonOptions{maxDepth: 4, maxElems: -1}, want: `[{"$truncated":2}]`},
+		{name: "empty slice max_elems 0", v: []int{}, opts: jsonOptions{maxDepth: 4}, want: `[]`},
+		{name: "array", v: [2]string{"a", "b"}, opts: jsonOptions{maxDepth: 4, maxElems: 10}, want: `["a","b"]`},
+		{name: "map", v: map[string]int{"b": 2, "a": 1}, opts: jsonOptions{maxDepth: 4, maxElems: 10}, want: `{"a":1,"b":2}`},
+		{name: "map truncated", v: map[int]bool{1: true, 2: false, 3: true}, opts: jsonOptions{maxDepth: 4, maxElems: 2}, want: `{"1":true,"2":false,"$truncated":1}`},
+		{name: "map max_elems 0", v: map[string]int{"a": 1}, opts: jsonOptions{maxDepth: 4}, want: `{"$truncated":1}`},
+		{name: "empty map max_elems 0", v: map[string]int{}, opts: jsonOptions{maxDepth: 4}, want: `{}`},
+		{name: "nil", v: []int(nil), opts: jsonOptions{maxDepth: 4}, want: `null`},
+		{name: "bytes", v: []byte("hi"), opts: jsonOptions{maxDepth: 4}, want: `"hi"`},
+		{name: "cycle", v: cycle, opts: jsonOptions{maxDepth: 4, maxElems: 10}, want: `{"Name":"a","Next":{"$cycle":"*go_watch.node"}}`},
+		{name: "max depth", v: []interface{}{[]int{1}}, opts: jsonOptions{maxDepth: 1, maxElems: 10}, want: `[{"$max_depth":"[]int"}]`},
+		{name: "unexported", v: struct{ a, b int }{1, 2}, opts: jsonOptions{maxDepth: 4, maxElems: 10}, want: `{"a":1,"b":2}`},
+		{name: "indent", v: map[string][]int{"a": {1, 2}}, opts: jsonOptions{maxDepth: 4, maxElems: 1, indent: " "}, want: "{\n \"a\": [\n  1,\n  {\n   \"$truncated\": 1\n  }\n ]\n}"},
+		{name: "indent max_elems 0", v: map[string][]int{"a": {1, 2}}, opts: jsonOptions{maxDepth: 4, indent: " "}, want: "{\n \"$truncated\": 1\n}"},
+	}
+
+	for _, tt := range tests {
+		got, err := toJSON(reflect.ValueOf(tt.v), tt.opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: toJSON = %s, want %s", tt.name, got, tt.want)
+		}
+		if !json.Valid([]byte(got)) {
+			t.Errorf("%s: invalid json %s", tt.name, got)
+		}
+	}
+}
+
+func TestLuaToJSON(t *testing.T) {
+	state, out := newTestState(t, &testRole{ID: 1, Items: []int{1, 2}, Attrs: map[string]int{"hp": 3}})
+	err := Execute(state, testScript(`
+		print(go_watch.to_json(role.Items, {max_elems = 0}))
+		print(go_watch.to_json(role.Attrs, {max_elems = 0, indent = "  "}))
+	`), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[{\"$truncated\":2}]\n{\n  \"$truncated\": 1\n}"; out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,233 @@
+package go_watch
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const valueMetaName = "go_watch.value"
+
+// registerValueMeta lets scripts write `root.map1[1].name = "x"`, metamethods are checked as the matching exports.
+// slice/array indexes start from 0 like array_get
+func (ctx *Context) registerValueMeta(state *lua.LState) {
+	mt := state.NewTypeMetatable(valueMetaName)
+	state.SetFuncs(mt, map[string]lua.LGFunction{
+		"__index":    ctx.wrapExport("get_path", lValueIndex),
+		"__newindex": ctx.wrapExport("set_path", lValueNewIndex),
+		"__len":      ctx.wrapExport("get_len", lValueLen),
+		"__call":     ctx.wrapExport("call", lCall),
+		"__tostring": ctx.wrapExport("to_string", lValueToString),
+		"__eq":       ctx.wrapExport("to_string", lValueEq),
+		"__pairs":    ctx.wrapExport("map_foreach", lValuePairs),
+	})
+}
+
+func indexSegment(v reflect.Value, key lua.LValue) pathSegment {
+	if name, ok := key.(lua.LString); ok {
+		if ind, err := indirect(v); err == nil && ind.Kind() == reflect.Struct {
+			return pathSegment{field: string(name)}
+		}
+	}
+	return pathSegment{key: key}
+}
+
+func lValueIndex(state *lua.LState) int {
+	ud := state.CheckUserData(1)
+	key := state.Get(2)
+
+	v := userDataValue(ud)
+	seg := indexSegment(v, key)
+	ret, err := pathStep(v, seg)
+	if err != nil {
+		// exported methods, e.g. `role.Add(1, 2)`
+		if name, ok := key.(lua.LString); ok {
+			if m, symbol := methodByName(v, string(name)); m.IsValid() {
+				ctx := getContext(state)
+				ctx.checkFunc(state, "call", symbol)
+				state.Push(newUserData(state, &methodValue{fn: m, symbol: symbol}))
+				return 1
+			}
+		}
+		if seg.key != nil {
+			// missing slice index acts like a missing map key
+			if ind, ierr := indirect(v); ierr == nil && (ind.Kind() == reflect.Slice || ind.Kind() == reflect.Array) {
+				return 0
+			}
+		}
+		state.RaiseError(err.Error())
+	}
+	if !ret.IsValid() {
+		return 0
+	}
+	state.Push(newUserData(state, ret))
+	return 1
+}
+
+// methodValue is a method looked up by the metatable. reflect method values all run reflect.methodValueCall,
+// so the name of the method like pkg.(*T).M is kept for the policy of call
+type methodValue struct {
+	fn     reflect.Value
+	symbol string
+}
+
+// methodByName returns the method value and the name of the method, the name is empty when unknown
+func methodByName(v reflect.Value, name string) (reflect.Value, string) {
+	if !v.IsValid() {
+		return reflect.Value{}, ""
+	}
+	if m := v.MethodByName(name); m.IsValid() {
+		return m, methodSymbol(v, name)
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() {
+		return v.Addr().MethodByName(name), methodSymbol(v.Addr(), name)
+	}
+	return reflect.Value{}, ""
+}
+
+func methodSymbol(v reflect.Value, name string) string {
+	if v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	m, ok := v.Type().MethodByName(name)
+	if !ok || !m.Func.IsValid() {
+		return ""
+	}
+	if f := runtime.FuncForPC(m.Func.Pointer()); f != nil {
+		return f.Name()
+	}
+	return ""
+}
+
+func lValueNewIndex(state *lua.LState) int {
+	ctx := getContext(state)
+	ud := state.CheckUserData(1)
+	key := state.Get(2)
+	newVal := state.Get(3)
+
+	v := userDataValue(ud)
+	if err := ctx.setPath(v, []pathSegment{indexSegment(v, key)}, newVal); err != nil {
+		state.RaiseError(err.Error())
+	}
+	return 0
+}
+
+func lValueLen(state *lua.LState) int {
+	ud := state.CheckUserData(1)
+	v, err := indirect(userDataValue(ud))
+	if err != nil {
+		state.RaiseError(err.Error())
+	}
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.String, reflect.Chan:
+		state.Push(lua.LNumber(v.Len()))
+		return 1
+	default:
+		state.RaiseError(fmt.Sprintf("%s has no len", v.Type()))
+		return 0
+	}
+}
+
+func lValueToString(state *lua.LState) int {
+	ud := state.CheckUserData(1)
+	if t, ok := ud.Value.(reflect.Type); ok {
+		state.Push(lua.LString(typeString(t)))
+		return 1
+	}
+	state.Push(lua.LString(formatValue(userDataValue(ud))))
+	return 1
+}
+
+func lValueEq(state *lua.LState) int {
+	a := state.CheckUserData(1)
+	b := state.CheckUserData(2)
+
+	ta, aIsType := a.Value.(reflect.Type)
+	tb, bIsType := b.Value.(reflect.Type)
+	if aIsType || bIsType {
+		state.Push(lua.LBool(aIsType && bIsType && ta == tb))
+		return 1
+	}
+
+	state.Push(lua.LBool(valueEqual(userDataValue(a), userDataValue(b))))
+	return 1
+}
+
+func valueEqual(a reflect.Value, b reflect.Value) bool {
+	if !a.IsValid() || !b.IsValid() {
+		return a.IsValid() == b.IsValid()
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch a.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return a.Pointer() == b.Pointer()
+	case reflect.Slice:
+		return a.Pointer() == b.Pointer() && a.Len() == b.Len()
+	}
+	// %#v compares values without Interface, which panics on unexported fields
+	return formatValue(a) == formatValue(b)
+}
+
+// lValuePairs iterates map entries, slice/array elements from index 0 or struct fields
+func lValuePairs(state *lua.LState) int {
+	ctx := getContext(state)
+	ud := state.CheckUserData(1)
+	v, err := indirect(userDataValue(ud))
+	if err != nil {
+		state.RaiseError(err.Error())
+	}
+
+	var next func(state *lua.LState) int
+	i := 0
+	switch v.Kind() {
+	case reflect.Map:
+		keys := v.MapKeys()
+		next = func(state *lua.LState) int {
+			for ; i < len(keys); i++ {
+				val := v.MapIndex(keys[i])
+				if !val.IsValid() {
+					continue
+				}
+				state.Push(newUserData(state, keys[i]))
+				state.Push(newUserData(state, val))
+				i++
+				return 2
+			}
+			return 0
+		}
+	case reflect.Slice, reflect.Array:
+		next = func(state *lua.LState) int {
+			if i >= v.Len() {
+				return 0
+			}
+			state.Push(lua.LNumber(i))
+			state.Push(newUserData(state, v.Index(i)))
+			i++
+			return 2
+		}
+	case reflect.Struct:
+		next = func(state *lua.LState) int {
+			if i >= v.NumField() {
+				return 0
+			}
+			state.Push(lua.LString(v.Type().Field(i).Name))
+			state.Push(newUserData(state, exposeField(v.Field(i))))
+			i++
+			return 2
+		}
+	default:
+		state.RaiseError(fmt.Sprintf("%s can not iterate", v.Type()))
+	}
+
+	state.Push(state.NewFunction(ctx.wrapExport("map_foreach", next)))
+	state.Push(ud)
+	state.Push(lua.LNil)
+	return 3
+}
@@ -0,0 +1,452 @@
+package go_watch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// entryPatchLen is the size of the jump written at the entry of a function: MOVQ $stub, DX; JMP DX
+const entryPatchLen = 12
+
+// integer argument registers of the amd64 register ABI in assignment order: AX BX CX DI SI R8 R9 R10 R11
+var intArgRegs = []byte{0, 3, 1, 7, 6, 8, 9, 10, 11}
+
+// trampolineFail is where the copied stack check jumps instead of runtime.morestack in calls of the wrapper,
+// it sets trampolineFunc.failed, clears the integer result registers so no stale pointers are returned,
+// and returns to the caller
+var trampolineFail = []byte{
+	0xc6, 0x42, 0x08, 0x01, // MOVB $1, 8(DX)
+	0x31, 0xc0, // XORL AX, AX
+	0x31, 0xdb, // XORL BX, BX
+	0x31, 0xc9, // XORL CX, CX
+	0x31, 0xff, // XORL DI, DI
+	0x31, 0xf6, // XORL SI, SI
+	0x45, 0x31, 0xc0, // XORL R8, R8
+	0x45, 0x31, 0xc9, // XORL R9, R9
+	0x45, 0x31, 0xd2, // XORL R10, R10
+	0x45, 0x31, 0xdb, // XORL R11, R11
+	0xc3, // RET
+}
+
+// entryPatch redirects the calls of a function to target. the patched entry jumps to a stub, which calls the
+// wrapper, or runs the function directly when an argument points into the goroutine stack: the wrapper holds
+// the arguments in reflect values, which are not moved with the stack.
+// the instructions overwritten at the entry run in two trampolines, which jump back behind the patch.
+// the direct one keeps the stack check, the one called by the wrapper reports a failed check in trampolineFunc.
+// patches are never removed, a thread may still be inside one, restoring a trace sets target back
+type entryPatch struct {
+	ftyp    reflect.Type
+	code    []byte        // mmapped stub and trampolines
+	traced  int           // offset of the trampoline called by the wrapper
+	target  reflect.Value // func variable called by the wrapper
+	wrapper reflect.Value // called by the stub, which only holds its address
+}
+
+var entryPatches = struct {
+	sync.Mutex
+	byEntry map[uintptr]*entryPatch
+}{byEntry: make(map[uintptr]*entryPatch)}
+
+// trampolineFunc is the closure of a trampoline call, DX points to it in the trampoline
+type trampolineFunc struct {
+	code   uintptr
+	failed bool // the stack check of the copied instructions failed, nothing else ran
+}
+
+// patchEntry makes the function at [entry, end) of type ftyp call the returned func variable,
+// which calls the function until it is set to something else
+func patchEntry(entry uintptr, end uintptr, ftyp reflect.Type) (reflect.Value, error) {
+	entryPatches.Lock()
+	defer entryPatches.Unlock()
+	if p := entryPatches.byEntry[entry]; p != nil {
+		if p.ftyp != ftyp {
+			return reflect.Value{}, fmt.Errorf("patched as %s", p.ftyp.String())
+		}
+		return p.target, nil
+	}
+
+	// the entry is written with two aligned atomic stores
+	if entry%16 != 0 {
+		return reflect.Value{}, errors.New("entry is not 16 byte aligned")
+	}
+	if end < entry+16 {
+		return reflect.Value{}, errors.New("function is shorter than 16 bytes")
+	}
+	regs, err := pointerRegs(ftyp)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	pr, err := decodePrologue(entry, end)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	p := &entryPatch{ftyp: ftyp}
+	p.target = reflect.New(ftyp).Elem()
+	p.target.Set(reflect.MakeFunc(ftyp, p.call))
+	p.wrapper = reflect.MakeFunc(ftyp, func(args []reflect.Value) []reflect.Value {
+		return callValue(p.target, args)
+	})
+	fn := reflect.New(ftyp)
+	fn.Elem().Set(p.wrapper)
+	closure := *(*uint64)(unsafe.Pointer(fn.Pointer()))
+
+	// MOVQ (R14), R12; MOVQ 8(R14), R13: g.stack.lo and g.stack.hi, R12 and R13 are free at the entry
+	code := []byte{0x4d, 0x8b, 0x26, 0x4d, 0x8b, 0x6e, 0x08}
+	var direct []int
+	for _, reg := range regs {
+		rex := 0x4c | reg>>3
+		code = append(code, rex, 0x39, 0xe0|reg&7, 0x72, 0x09)             // skip the next check when reg < lo
+		code = append(code, rex, 0x39, 0xe8|reg&7, 0x0f, 0x82, 0, 0, 0, 0) // jump to the direct trampoline when reg < hi
+		direct = append(direct, len(code))
+	}
+	code = append(code, 0x48, 0xba) // MOVQ $closure, DX
+	code = appendUint64(code, closure)
+	code = append(code, 0xff, 0x22) // JMP (DX)
+	for _, next := range direct {
+		putRel32(code, next, len(code))
+	}
+	code = pr.emit(code, entry, appendJump)
+	p.traced = len(code)
+	code = pr.emit(code, entry, func(code []byte, morestack uintptr) []byte {
+		return append(code, trampolineFail...)
+	})
+
+	if p.code, err = syscall.Mmap(-1, 0, len(code), syscall.PROT_READ|syscall.PROT_WRITE|syscall.PROT_EXEC, syscall.MAP_PRIVATE|syscall.MAP_ANON); err != nil {
+		return reflect.Value{}, err
+	}
+	copy(p.code, code)
+
+	patch := []byte{0x48, 0xba} // MOVQ $stub, DX
+	patch = appendUint64(patch, uint64(uintptr(unsafe.Pointer(&p.code[0]))))
+	patch = append(patch, 0xff, 0xe2) // JMP DX
+	patch = append(patch, textBytes(entry+entryPatchLen, 16-entryPatchLen)...)
+	if err := writeEntry(entry, patch); err != nil {
+		syscall.Munmap(p.code)
+		return reflect.Value{}, err
+	}
+	entryPatches.byEntry[entry] = p
+	return p.target, nil
+}
+
+// call runs the function through the trampoline, growing the stack while its stack check fails
+func (p *entryPatch) call(args []reflect.Value) []reflect.Value {
+	for i := 0; ; i++ {
+		closure := &trampolineFunc{code: uintptr(unsafe.Pointer(&p.code[p.traced]))}
+		ptr := unsafe.Pointer(closure)
+		results := callValue(reflect.NewAt(p.ftyp, unsafe.Pointer(&ptr)).Elem(), args)
+		if !closure.failed {
+			return results
+		}
+		if i >= 20 {
+			panic("go_watch: stack of traced function not grown")
+		}
+		// also reschedules when the check failed for a preemption request
+		growStack(1 << i)
+	}
+}
+
+// growStack uses n KB of stack, the runtime keeps the grown stack after it returns
+//
+//go:noinline
+func growStack(n int) byte {
+	var buf [1024]byte
+	if n > 1 {
+		buf[n%len(buf)] = growStack(n - 1)
+	}
+	return buf[n%len(buf)]
+}
+
+// argAssign assigns arguments to registers like the amd64 register ABI, and records the integer registers holding pointers
+type argAssign struct {
+	ints   int
+	floats int
+	ptrs   []byte
+}
+
+func (a *argAssign) assign(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.int(false)
+	case reflect.Ptr, reflect.UnsafePointer, reflect.Chan, reflect.Map, reflect.Func:
+		return a.int(true)
+	case reflect.Float32, reflect.Float64:
+		return a.float(1)
+	case reflect.Complex64, reflect.Complex128:
+		return a.float(2)
+	case reflect.String:
+		return a.int(true) && a.int(false)
+	case reflect.Slice:
+		return a.int(true) && a.int(false) && a.int(false)
+	case reflect.Interface:
+		// the type word never points into a stack
+		return a.int(false) && a.int(true)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if !a.assign(t.Field(i).Type) {
+				return false
+			}
+		}
+		return true
+	case reflect.Array:
+		switch t.Len() {
+		case 0:
+			return true
+		case 1:
+			return a.assign(t.Elem())
+		}
+	}
+	return false
+}
+
+func (a *argAssign) int(ptr bool) bool {
+	if a.ints >= len(intArgRegs) {
+		return false
+	}
+	if ptr {
+		a.ptrs = append(a.ptrs, intArgRegs[a.ints])
+	}
+	a.ints++
+	return true
+}
+
+func (a *argAssign) float(n int) bool {
+	if a.floats+n > 15 {
+		return false
+	}
+	a.floats += n
+	return true
+}
+
+// pointerRegs returns the registers of the pointer arguments of ftyp, arguments holding pointers
+// passed on the stack are not supported, the stub only checks registers
+func pointerRegs(ftyp reflect.Type) ([]byte, error) {
+	a := &argAssign{}
+	for i := 0; i < ftyp.NumIn(); i++ {
+		saved := *a
+		if !a.assign(ftyp.In(i)) {
+			*a = saved
+			if hasPointers(ftyp.In(i)) {
+				return nil, fmt.Errorf("argument %d is passed on the stack", i+1)
+			}
+		}
+	}
+	return a.ptrs, nil
+}
+
+func hasPointers(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.UnsafePointer, reflect.Chan, reflect.Map, reflect.Func,
+		reflect.String, reflect.Slice, reflect.Interface:
+		return true
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if hasPointers(t.Field(i).Type) {
+				return true
+			}
+		}
+	case reflect.Array:
+		return t.Len() > 0 && hasPointers(t.Elem())
+	}
+	return false
+}
+
+// prologue is the first instructions of a function, overwritten by the patch, and the rest of the stack check
+type prologue struct {
+	insts []prologueInst
+	n     int
+}
+
+type prologueInst struct {
+	raw       []byte
+	check     bool // conditional jump of the stack check
+	cond      byte
+	morestack uintptr
+}
+
+// decodePrologue decodes the instructions at entry, the only relative instructions allowed are the jumps
+// of the stack check to the runtime.morestack call of the function
+func decodePrologue(entry uintptr, end uintptr) (*prologue, error) {
+	text := textBytes(entry, int(end-entry))
+	pr := &prologue{}
+	for pr.n < entryPatchLen || stackCheckAhead(entry+uintptr(pr.n), end) {
+		inst, err := x86asm.Decode(text[pr.n:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("decode +%d: %s", pr.n, err.Error())
+		}
+		pi := prologueInst{raw: text[pr.n : pr.n+inst.Len]}
+		pr.n += inst.Len
+		switch inst.Op {
+		case x86asm.RET, x86asm.JMP, x86asm.INT:
+			return nil, errors.New("function ends inside the patched instructions")
+		}
+		if inst.PCRel != 0 {
+			var ok bool
+			if pi.cond, pi.morestack, ok = stackCheckJump(inst, pi.raw, entry+uintptr(pr.n), end); !ok {
+				return nil, fmt.Errorf("%s in the first instructions is not the stack check", inst.Op.String())
+			}
+			pi.check = true
+		}
+		pr.insts = append(pr.insts, pi)
+	}
+	if err := checkBranches(entry, end, pr.n); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+// emit appends the copied instructions and the jump back behind them, the jumps of the stack check
+// go to the code appended by onCheck, given the morestack block the function jumps to
+func (pr *prologue) emit(code []byte, entry uintptr, onCheck func(code []byte, morestack uintptr) []byte) []byte {
+	var checks []int
+	for _, inst := range pr.insts {
+		if !inst.check {
+			code = append(code, inst.raw...)
+			continue
+		}
+		code = append(code, 0x0f, 0x80|inst.cond, 0, 0, 0, 0)
+		checks = append(checks, len(code))
+	}
+	code = appendJump(code, entry+uintptr(pr.n))
+	i := 0
+	for _, inst := range pr.insts {
+		if inst.check {
+			putRel32(code, checks[i], len(code))
+			code = onCheck(code, inst.morestack)
+			i++
+		}
+	}
+	return code
+}
+
+// appendJump appends JMP *0(IP) followed by the absolute address
+func appendJump(code []byte, to uintptr) []byte {
+	return appendUint64(append(code, 0xff, 0x25, 0, 0, 0, 0), uint64(to))
+}
+
+func appendUint64(code []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(code, b[:]...)
+}
+
+// putRel32 sets the rel32 ending at next to jump to target
+func putRel32(code []byte, next int, target int) {
+	binary.LittleEndian.PutUint32(code[next-4:], uint32(int32(target-next)))
+}
+
+// stackCheckJump returns the condition and the target of a Jcc to the runtime.morestack call of the function,
+// next is the pc after it
+func stackCheckJump(inst x86asm.Inst, raw []byte, next uintptr, end uintptr) (byte, uintptr, bool) {
+	rel, ok := inst.Args[0].(x86asm.Rel)
+	if !ok {
+		return 0, 0, false
+	}
+	var cond byte
+	switch {
+	case raw[0] >= 0x70 && raw[0] <= 0x7f:
+		cond = raw[0] & 0xf
+	case len(raw) == 6 && raw[0] == 0x0f && raw[1] >= 0x80 && raw[1] <= 0x8f:
+		cond = raw[1] & 0xf
+	default:
+		return 0, 0, false
+	}
+	target := next + uintptr(int64(rel))
+	return cond, target, target >= next && target < end && callsMorestack(target, end)
+}
+
+// stackCheckAhead reports whether one of the next instructions is a jump of the stack check,
+// large frames compare twice and the check may end behind the patch
+func stackCheckAhead(pc uintptr, end uintptr) bool {
+	for i := 0; i < 3 && pc < end; i++ {
+		inst, err := x86asm.Decode(textBytes(pc, int(end-pc)), 64)
+		if err != nil {
+			return false
+		}
+		raw := textBytes(pc, inst.Len)
+		pc += uintptr(inst.Len)
+		if inst.PCRel != 0 {
+			_, _, ok := stackCheckJump(inst, raw, pc, end)
+			return ok
+		}
+	}
+	return false
+}
+
+// callsMorestack reports whether the block at pc calls runtime.morestack, after spilling the register arguments
+func callsMorestack(pc uintptr, end uintptr) bool {
+	for i := 0; i < 32 && pc < end; i++ {
+		inst, err := x86asm.Decode(textBytes(pc, int(end-pc)), 64)
+		if err != nil {
+			return false
+		}
+		pc += uintptr(inst.Len)
+		switch inst.Op {
+		case x86asm.CALL:
+			rel, ok := inst.Args[0].(x86asm.Rel)
+			if !ok {
+				return false
+			}
+			fn := runtime.FuncForPC(pc + uintptr(int64(rel)))
+			return fn != nil && strings.HasPrefix(fn.Name(), "runtime.morestack")
+		case x86asm.JMP, x86asm.RET:
+			return false
+		}
+	}
+	return false
+}
+
+// checkBranches fails when a jump of the function lands inside the first n bytes, they are overwritten by the patch
+func checkBranches(entry uintptr, end uintptr, n int) error {
+	text := textBytes(entry, int(end-entry))
+	for off := 0; off < len(text); {
+		inst, err := x86asm.Decode(text[off:], 64)
+		if err != nil {
+			return fmt.Errorf("decode +%d: %s", off, err.Error())
+		}
+		off += inst.Len
+		if rel, ok := inst.Args[0].(x86asm.Rel); ok && inst.PCRel != 0 {
+			target := off + int(rel)
+			if target > 0 && target < n {
+				return fmt.Errorf("jump to +%d inside the patched instructions", target)
+			}
+		}
+	}
+	return nil
+}
+
+// writeEntry writes the 16 bytes of patch at entry. threads reaching the entry meanwhile spin on a jump to itself
+// until the last store, the copy of the old instructions is not used before it
+func writeEntry(entry uintptr, patch []byte) error {
+	pageSize := uintptr(syscall.Getpagesize())
+	page := textBytes(entry&^(pageSize-1), int(pageSize))
+	if err := syscall.Mprotect(page, syscall.PROT_READ|syscall.PROT_WRITE|syscall.PROT_EXEC); err != nil {
+		return err
+	}
+	defer syscall.Mprotect(page, syscall.PROT_READ|syscall.PROT_EXEC)
+
+	code := textBytes(entry, 16)
+	first := (*uint64)(unsafe.Pointer(&code[0]))
+	second := (*uint64)(unsafe.Pointer(&code[8]))
+	spin := atomic.LoadUint64(first)&^0xffff | 0xfeeb // JMP -2
+	atomic.StoreUint64(first, spin)
+	atomic.StoreUint64(second, binary.LittleEndian.Uint64(patch[8:]))
+	atomic.StoreUint64(first, binary.LittleEndian.Uint64(patch))
+	return nil
+}
+
+// textBytes returns the n bytes of code at pc, pc is not a go pointer
+func textBytes(pc uintptr, n int) []byte {
+	return unsafe.Slice(*(**byte)(unsafe.Pointer(&pc)), n)
+}
@@ -0,0 +1,136 @@
+package go_watch
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type patchTarget struct {
+	name string
+}
+
+//go:noinline
+func (t *patchTarget) setName(name string, n int) string {
+	t.name = strings.Repeat(name, n)
+	return t.name
+}
+
+// bigFrame needs more than the 8KB stack of a new goroutine
+//
+//go:noinline
+func bigFrame(i int) int {
+	var buf [16 << 10]byte
+	buf[i] = byte(i)
+	return sumBytes(buf[:]) + len(buf)
+}
+
+//go:noinline
+func sumBytes(b []byte) int {
+	sum := 0
+	for _, c := range b {
+		sum += int(c)
+	}
+	return sum
+}
+
+// funcRange returns the entry and the end of fn without debug info, the end is the first pc of another function
+func funcRange(fn interface{}) (uintptr, uintptr) {
+	entry := reflect.ValueOf(fn).Pointer()
+	end := entry
+	for f := runtime.FuncForPC(end); f != nil && f.Entry() == entry; f = runtime.FuncForPC(end) {
+		end++
+	}
+	return entry, end
+}
+
+// patchFunc patches fn and counts its calls, it returns the count and the func variable of the patch
+func patchFunc(t *testing.T, fn interface{}) (*int64, reflect.Value) {
+	t.Helper()
+	entry, end := funcRange(fn)
+	target, err := patchEntry(entry, end, reflect.TypeOf(fn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	calls := new(int64)
+	orig := reflect.New(target.Type()).Elem()
+	orig.Set(target)
+	target.Set(reflect.MakeFunc(target.Type(), func(args []reflect.Value) []reflect.Value {
+		mu.Lock()
+		*calls++
+		mu.Unlock()
+		return callValue(orig, args)
+	}))
+	t.Cleanup(func() { target.Set(orig) })
+	return calls, target
+}
+
+// patchTargets are on the heap, calls with a receiver on the stack are not traced
+var patchTargets []*patchTarget
+
+func TestPatchEntry(t *testing.T) {
+	calls, target := patchFunc(t, (*patchTarget).setName)
+	patchTargets = []*patchTarget{{}}
+	p := patchTargets[0]
+	if got := p.setName("ab", 2); got != "abab" || p.name != "abab" || *calls != 1 {
+		t.Errorf("setName = %q name = %q calls = %d, want abab abab 1", got, p.name, *calls)
+	}
+	var local patchTarget
+	if got := local.setName("ab", 1); got != "ab" || local.name != "ab" || *calls != 1 {
+		t.Errorf("setName on the stack = %q name = %q calls = %d, want ab ab 1", got, local.name, *calls)
+	}
+
+	// the same entry gives the same func variable
+	entry, end := funcRange((*patchTarget).setName)
+	if again, err := patchEntry(entry, end, reflect.TypeOf((*patchTarget).setName)); err != nil || again != target {
+		t.Errorf("patch again = %v %v, want the first func variable", again, err)
+	}
+	if _, err := patchEntry(entry, end, reflect.TypeOf(bigFrame)); err == nil {
+		t.Error("patch with another type succeeded")
+	}
+
+	// calls from many goroutines, some at the end of their stack
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		patchTargets = append(patchTargets, &patchTarget{})
+		wg.Add(1)
+		go func(i int, p *patchTarget) {
+			defer wg.Done()
+			var deep func(n int)
+			deep = func(n int) {
+				if n > 0 {
+					deep(n - 1)
+				}
+				if got := p.setName("x", i); got != strings.Repeat("x", i) {
+					t.Errorf("setName(x, %d) = %q", i, got)
+				}
+			}
+			deep(100)
+		}(i, patchTargets[i+1])
+	}
+	wg.Wait()
+	if *calls != 1+8*101 {
+		t.Errorf("calls = %d, want %d", *calls, 1+8*101)
+	}
+}
+
+func TestPatchEntryGrowStack(t *testing.T) {
+	calls, _ := patchFunc(t, bigFrame)
+	done := make(chan int)
+	// the stack check of the trampoline fails on the small stack of a new goroutine
+	go func() { done <- bigFrame(3) }()
+	if got := <-done; got != 3+16<<10 || *calls != 1 {
+		t.Errorf("bigFrame = %d calls = %d, want %d 1", got, *calls, 3+16<<10)
+	}
+}
+
+func TestPatchEntryReject(t *testing.T) {
+	// too short to hold the patch
+	entry, end := funcRange(discardPrint)
+	if _, err := patchEntry(entry, end, reflect.TypeOf(discardPrint)); err == nil {
+		t.Error("patched a function shorter than the patch")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux || !amd64
+// +build !linux !amd64
+
+package go_watch
+
+import (
+	"errors"
+	"reflect"
+)
+
+// patchEntry needs to decode and write machine code, which is only done on linux/amd64
+func patchEntry(entry uintptr, end uintptr, ftyp reflect.Type) (reflect.Value, error) {
+	return reflect.Value{}, errors.New("functions are only traced on linux/amd64")
+}
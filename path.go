@@ -0,0 +1,259 @@
+package go_watch
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// pathSegment is `.field` or `[key]`, key is a lua number or string
+type pathSegment struct {
+	field string
+	key   lua.LValue
+}
+
+func (seg pathSegment) String() string {
+	if seg.key == nil {
+		return "." + seg.field
+	}
+	if s, ok := seg.key.(lua.LString); ok {
+		return fmt.Sprintf("[%q]", string(s))
+	}
+	return "[" + seg.key.String() + "]"
+}
+
+// parsePath parses `a.b[3].c["key"]`, the leading dot is optional
+func parsePath(path string) ([]pathSegment, error) {
+	var segs []pathSegment
+	i := 0
+	for i < len(path) {
+		switch c := path[i]; {
+		case c == '.' || (i == 0 && c != '['):
+			if c == '.' {
+				i++
+			}
+			start := i
+			for i < len(path) && path[i] != '.' && path[i] != '[' && path[i] != ']' {
+				i++
+			}
+			if start == i {
+				return nil, fmt.Errorf("path:%s empty field at %d", path, start)
+			}
+			segs = append(segs, pathSegment{field: path[start:i]})
+		case c == '[':
+			j := i + 1
+			for j < len(path) && path[j] == ' ' {
+				j++
+			}
+			if j < len(path) && (path[j] == '"' || path[j] == '\'') {
+				// quoted keys may contain '.' and ']'
+				end := quotedEnd(path, j)
+				if end < 0 {
+					return nil, fmt.Errorf("path:%s unterminated string at %d", path, j)
+				}
+				key, err := unquoteKey(path[j : end+1])
+				if err != nil {
+					return nil, fmt.Errorf("path:%s bad string key %s", path, path[j:end+1])
+				}
+				j = end + 1
+				for j < len(path) && path[j] == ' ' {
+					j++
+				}
+				if j >= len(path) || path[j] != ']' {
+					return nil, fmt.Errorf("path:%s missing ']' at %d", path, j)
+				}
+				segs = append(segs, pathSegment{key: lua.LString(key)})
+				i = j + 1
+				continue
+			}
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("path:%s missing ']' at %d", path, i)
+			}
+			raw := strings.TrimSpace(path[i+1 : i+end])
+			n, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return nil, fmt.Errorf("path:%s bad key %s, need number or quoted string", path, raw)
+			}
+			segs = append(segs, pathSegment{key: lua.LNumber(n)})
+			i += end + 1
+		default:
+			return nil, fmt.Errorf("path:%s unexpected %q at %d", path, c, i)
+		}
+	}
+	return segs, nil
+}
+
+func quotedEnd(path string, start int) int {
+	quote := path[start]
+	for i := start + 1; i < len(path); i++ {
+		switch path[i] {
+		case '\\':
+			i++
+		case quote:
+			return i
+		}
+	}
+	return -1
+}
+
+func unquoteKey(quoted string) (string, error) {
+	if quoted[0] == '\'' {
+		quoted = `"` + strings.ReplaceAll(strings.ReplaceAll(quoted[1:len(quoted)-1], `\'`, `'`), `"`, `\"`) + `"`
+	}
+	return strconv.Unquote(quoted)
+}
+
+// indirect follows pointers and interfaces
+func indirect(v reflect.Value) (reflect.Value, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, fmt.Errorf("nil %s", v.Type())
+		}
+		v = v.Elem()
+	}
+	return v, nil
+}
+
+func pathStep(v reflect.Value, seg pathSegment) (reflect.Value, error) {
+	v, err := indirect(v)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	if seg.key == nil {
+		return fieldByName(v, seg.field)
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		k, err := luaToValue(seg.key, v.Type().Key())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return v.MapIndex(k), nil
+	case reflect.Slice, reflect.Array, reflect.String:
+		n, ok := seg.key.(lua.LNumber)
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("%s need number index", v.Type())
+		}
+		i := int(n)
+		if i < 0 || i >= v.Len() {
+			return reflect.Value{}, fmt.Errorf("index %d out of range %d", i, v.Len())
+		}
+		return v.Index(i), nil
+	default:
+		return reflect.Value{}, fmt.Errorf("%s can not index", v.Type())
+	}
+}
+
+func getPath(v reflect.Value, segs []pathSegment) (reflect.Value, error) {
+	for i, seg := range segs {
+		var err error
+		v, err = pathStep(v, seg)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("%s: %s", formatPath(segs[:i+1]), err.Error())
+		}
+		if !v.IsValid() {
+			return v, nil
+		}
+	}
+	return v, nil
+}
+
+// setPath sets the value at path, map elements are replaced with SetMapIndex
+func (ctx *Context) setPath(v reflect.Value, segs []pathSegment, newVal lua.LValue) error {
+	if len(segs) == 0 {
+		return fmt.Errorf("empty path")
+	}
+	path := formatPath(segs)
+	parent, err := getPath(v, segs[:len(segs)-1])
+	if err != nil {
+		return err
+	}
+	if !parent.IsValid() {
+		return fmt.Errorf("%s: not found", formatPath(segs[:len(segs)-1]))
+	}
+	parent, err = indirect(parent)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	last := segs[len(segs)-1]
+	if last.key != nil && parent.Kind() == reflect.Map {
+		k, err := luaToValue(last.key, parent.Type().Key())
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err.Error())
+		}
+		rv, err := luaToValue(newVal, parent.Type().Elem())
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err.Error())
+		}
+		audit := ctx.auditWrite("set_path", parent.Type(), path, parent.MapIndex(k))
+		parent.SetMapIndex(k, rv)
+		audit(rv)
+		return nil
+	}
+
+	target, err := pathStep(parent, last)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if !target.CanSet() {
+		return fmt.Errorf("%s: not addressable", path)
+	}
+	rv, err := luaToValue(newVal, target.Type())
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	audit := ctx.auditWrite("set_path", parent.Type(), path, target)
+	target.Set(rv)
+	audit(target)
+	return nil
+}
+
+func formatPath(segs []pathSegment) string {
+	var b strings.Builder
+	for _, seg := range segs {
+		b.WriteString(seg.String())
+	}
+	return strings.TrimPrefix(b.String(), ".")
+}
+
+func lGetPath(state *lua.LState) int {
+	ud := state.CheckUserData(1)
+	path := state.CheckString(2)
+
+	segs, err := parsePath(path)
+	if err != nil {
+		state.RaiseError(err.Error())
+	}
+	v, err := getPath(userDataValue(ud), segs)
+	if err != nil {
+		state.RaiseError(err.Error())
+	}
+	if !v.IsValid() {
+		return 0
+	}
+	state.Push(newUserData(state, v))
+	return 1
+}
+
+func lSetPath(state *lua.LState) int {
+	ctx := getContext(state)
+	ud := state.CheckUserData(1)
+	path := state.CheckString(2)
+	newVal := state.Get(3)
+
+	segs, err := parsePath(path)
+	if err != nil {
+		state.RaiseError(err.Error())
+	}
+	if err := ctx.setPath(userDataValue(ud), segs, newVal); err != nil {
+		state.RaiseError(err.Error())
+	}
+	return 0
+}
@@ -0,0 +1,64 @@
+package go_watch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string // segments joined by their String
+		err  string // part of the error message, empty for success
+	}{
+		{path: "a", want: ".a"},
+		{path: ".a.b", want: ".a.b"},
+		{path: "a[3].c", want: ".a[3].c"},
+		{path: "[1][2]", want: "[1][2]"},
+		{path: "a[ 3 ]", want: ".a[3]"},
+		{path: "a[-1.5]", want: ".a[-1.5]"},
+		{path: `a["key"]`, want: `.a["key"]`},
+		{path: `a['key']`, want: `.a["key"]`},
+		{path: `a[ "key" ]`, want: `.a["key"]`},
+		{path: `a["x.y"].b`, want: `.a["x.y"].b`},
+		{path: `a["x]y"]`, want: `.a["x]y"]`},
+		{path: `a['x]y']`, want: `.a["x]y"]`},
+		{path: `a["x\"]y"]`, want: `.a["x\"]y"]`},
+		{path: `a['it\'s']`, want: `.a["it's"]`},
+		{path: `a['say "hi"']`, want: `.a["say \"hi\""]`},
+		{path: `a["\n"]`, want: `.a["\n"]`},
+		{path: "", want: ""},
+
+		{path: "a..b", err: "empty field"},
+		{path: "a.", err: "empty field"},
+		{path: "a[1", err: "missing ']'"},
+		{path: "a[x]", err: "bad key x"},
+		{path: "a[]", err: "bad key"},
+		{path: `a["x]`, err: "unterminated string"},
+		{path: `a["x"`, err: "missing ']'"},
+		{path: `a["x" y]`, err: "missing ']'"},
+		{path: `a["\q"]`, err: "bad string key"},
+		{path: "a]", err: "unexpected ']'"},
+	}
+
+	for _, tt := range tests {
+		segs, err := parsePath(tt.path)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parsePath(%q) error = %v, want %q", tt.path, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePath(%q) error = %v", tt.path, err)
+			continue
+		}
+		var got strings.Builder
+		for _, seg := range segs {
+			got.WriteString(seg.String())
+		}
+		if got.String() != tt.want {
+			t.Errorf("parsePath(%q) = %s, want %s", tt.path, got.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package go_watch
+
+import (
+	"fmt"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Policy decides what a session may do, symbol is the resolved dwarf name of a function/global/type
+// or empty when only the export itself is checked
+type Policy interface {
+	Allow(session int, export string, symbol string) bool
+}
+
+type PolicyFunc func(session int, export string, symbol string) bool
+
+func (f PolicyFunc) Allow(session int, export string, symbol string) bool {
+	return f(session, export, symbol)
+}
+
+// Capability grants an export, optionally restricted to matching symbols.
+// patterns support '*' (any sequence, including '/' and '.') and '?' (any single byte)
+type Capability struct {
+	Export string
+	Symbol string // empty matches every symbol
+}
+
+// Capabilities allows what any entry grants, except that entries with a Symbol win over entries without one:
+// once an entry restricts the symbols of an export, {Export: "get_*"} no longer grants other symbols of that export
+type Capabilities []Capability
+
+func (caps Capabilities) Allow(session int, export string, symbol string) bool {
+	anySymbol, restricted := false, false
+	for _, c := range caps {
+		if !globMatch(c.Export, export) {
+			continue
+		}
+		if c.Symbol == "" {
+			anySymbol = true
+			continue
+		}
+		restricted = true
+		if symbol == "" || globMatch(c.Symbol, symbol) {
+			return true
+		}
+	}
+	return anySymbol && (symbol == "" || !restricted)
+}
+
+func WithPolicy(policy Policy) Option {
+	return func(ctx *Context) {
+		ctx.policy = policy
+	}
+}
+
+type PermissionError struct {
+	Export string
+	Symbol string
+	Reason string
+}
+
+func (e *PermissionError) Error() string {
+	if e.Symbol != "" {
+		return fmt.Sprintf("permission denied: %s(%s) %s", e.Export, e.Symbol, e.Reason)
+	}
+	return fmt.Sprintf("permission denied: %s %s", e.Export, e.Reason)
+}
+
+func (ctx *Context) allowSymbol(export string, symbol string) bool {
+	return ctx.policy == nil || ctx.policy.Allow(ctx.session, export, symbol)
+}
+
+func (ctx *Context) checkSymbol(state *lua.LState, export string, symbol string) {
+	if !ctx.allowSymbol(export, symbol) {
+		ctx.deny(state, &PermissionError{Export: export, Symbol: symbol, Reason: "not allowed by policy"})
+	}
+}
+
+// checkFunc checks the name of a function about to be called. without a name, e.g. funcs made by reflect,
+// nothing can be matched against the policy, so the call is denied
+func (ctx *Context) checkFunc(state *lua.LState, export string, symbol string) {
+	if ctx.policy != nil && (symbol == "" || strings.HasPrefix(symbol, "reflect.")) {
+		ctx.deny(state, &PermissionError{Export: export, Symbol: symbol, Reason: "unknown function not allowed by policy"})
+	}
+	ctx.checkSymbol(state, export, symbol)
+}
+
+func (ctx *Context) deny(state *lua.LState, err *PermissionError) {
+	if ctx.print != nil && !ctx.quietDeny {
+		ctx.print(ctx.session, err.Error())
+	}
+	ctx.err = err
+	state.RaiseError(err.Error())
+}
+
+func (ctx *Context) policyExport(name string, fn lua.LGFunction) lua.LGFunction {
+	return func(state *lua.LState) int {
+		if !ctx.allowSymbol(name, "") {
+			ctx.deny(state, &PermissionError{Export: name, Reason: "not allowed by policy"})
+		}
+		return fn(state)
+	}
+}
+
+func globMatch(pattern string, name string) bool {
+	px, nx := 0, 0
+	nextPx, nextNx := -1, -1
+	for px < len(pattern) || nx < len(name) {
+		if px < len(pattern) {
+			switch c := pattern[px]; c {
+			case '*':
+				nextPx, nextNx = px, nx+1
+				px++
+				continue
+			case '?':
+				if nx < len(name) {
+					px++
+					nx++
+					continue
+				}
+			default:
+				if nx < len(name) && name[nx] == c {
+					px++
+					nx++
+					continue
+				}
+			}
+		}
+		if nextNx > 0 && nextNx <= len(name) {
+			px, nx = nextPx, nextNx
+			continue
+		}
+		return false
+	}
+	return true
+}
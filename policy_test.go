@@ -0,0 +1,140 @@
+package go_watch
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "github.com/a/b.(*T).M", true},
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+		{"abc", "ab", false},
+		{"ab", "abc", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"?", "", false},
+		{"get_*", "get_number", true},
+		{"get_*", "set_number", false},
+		{"*_name", "search_func_name", true},
+		{"*_name", "search_func_names", false},
+		{"myapp/*", "myapp/admin.Reset", true},
+		{"myapp/*", "other/myapp/x.y", false},
+		{"myapp/admin.*", "myapp/admin.(*Server).Stop", true},
+		{"myapp/admin.*", "myapp/administrator.X", false},
+		{"*.(*RoleInfo).*", "main.(*RoleInfo).setName", true},
+		{"*.(*RoleInfo).*", "main.RoleInfo.setName", false},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "acb", false},
+		{"a*a*a", "aaaa", true},
+		{"*a", "bbba", true},
+		{"*a", "bbab", false},
+		{"**", "x", true},
+		{"*?", "", false},
+		{"*?", "x", true},
+	}
+
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCapabilitiesAllow(t *testing.T) {
+	caps := Capabilities{
+		{Export: "call_func_with_name", Symbol: "myapp/admin.*"},
+		{Export: "get_global_with_name", Symbol: "myapp/*"},
+		{Export: "get_*"},
+	}
+	tests := []struct {
+		export string
+		symbol string
+		want   bool
+	}{
+		{"call_func_with_name", "", true},
+		{"call_func_with_name", "myapp/admin.Reset", true},
+		{"call_func_with_name", "myapp/user.Delete", false},
+		{"get_global_with_name", "", true},
+		{"get_global_with_name", "myapp/config.maxOnline", true},
+		{"get_global_with_name", "os.Args", false},
+		{"get_type_with_name", "os.File", true},
+		{"get_number", "", true},
+		{"set_number", "", false},
+		{"call", "main.f", false},
+	}
+
+	for _, tt := range tests {
+		if got := caps.Allow(1, tt.export, tt.symbol); got != tt.want {
+			t.Errorf("Allow(%q, %q) = %v, want %v", tt.export, tt.symbol, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyCall(t *testing.T) {
+	noDangerous := PolicyFunc(func(session int, export string, symbol string) bool {
+		return !strings.Contains(symbol, "Dangerous")
+	})
+	tests := []struct {
+		name   string
+		policy Policy
+		script string
+		symbol string // symbol in the PermissionError, "-" when the script succeeds
+	}{
+		{name: "method", policy: noDangerous, script: `role.SetName("b")`, symbol: "-"},
+		{name: "method denied", policy: noDangerous, script: `role.Dangerous()`, symbol: "github.com/lsg2020/go-watch.(*testRole).Dangerous"},
+		{name: "method lookup denied", policy: noDangerous, script: `local f = role.Dangerous`, symbol: "github.com/lsg2020/go-watch.(*testRole).Dangerous"},
+		{name: "method by call", policy: noDangerous, script: `go_watch.call(role.Dangerous)`, symbol: "github.com/lsg2020/go-watch.(*testRole).Dangerous"},
+		{name: "func without name", policy: noDangerous, script: `role.Hook()`, symbol: "reflect.makeFuncStub"},
+		{name: "func without name no policy", script: `assert(go_watch.get_string(role.Hook()) == "hook")`, symbol: "-"},
+		{
+			name:   "capabilities",
+			policy: Capabilities{{Export: "call", Symbol: "*.(*testRole).SetName"}, {Export: "get_path"}, {Export: "root_get"}},
+			script: `role.SetName("b")`,
+			symbol: "-",
+		},
+		{
+			name:   "capabilities denied",
+			policy: Capabilities{{Export: "call", Symbol: "*.(*testRole).SetName"}, {Export: "get_path"}, {Export: "root_get"}},
+			script: `role.Dangerous()`,
+			symbol: "github.com/lsg2020/go-watch.(*testRole).Dangerous",
+		},
+	}
+
+	for _, tt := range tests {
+		role := &testRole{Name: "a"}
+		role.Hook = reflect.MakeFunc(reflect.TypeOf(role.Hook), func(args []reflect.Value) []reflect.Value {
+			return []reflect.Value{reflect.ValueOf("hook")}
+		}).Interface().(func() string)
+		var opts []Option
+		if tt.policy != nil {
+			opts = append(opts, WithPolicy(tt.policy))
+		}
+		state, _ := newTestState(t, role, opts...)
+		err := Execute(state, testScript(tt.script), 1)
+		if tt.symbol == "-" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		var permissionErr *PermissionError
+		if !errors.As(err, &permissionErr) || permissionErr.Symbol != tt.symbol {
+			t.Errorf("%s: error = %v, want permission error of %s", tt.name, err, tt.symbol)
+		}
+		if role.Level != 0 {
+			t.Errorf("%s: Dangerous was called", tt.name)
+		}
+	}
+}
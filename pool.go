@@ -0,0 +1,200 @@
+package go_watch
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+
+	"github.com/lsg2020/gort"
+	lua "github.com/yuin/gopher-lua"
+)
+
+var ErrPoolClosed = errors.New("pool closed")
+
+// Pool hands out lua states sharing one dwarf, at most size scripts run at the same time.
+// globals are reset after every script, so sessions do not see each other's globals
+type Pool struct {
+	root  RootFunc
+	print PrintFunc
+	dwarf *symbols
+	opts  []Option
+
+	idle   chan *poolState // nil entries are states not created yet
+	mu     sync.Mutex
+	closed bool
+}
+
+type poolState struct {
+	state    *lua.LState
+	snapshot stateSnapshot
+}
+
+// NewPool uses debug info of the current executable when dwarf is nil, size <= 0 means GOMAXPROCS
+func NewPool(root RootFunc, print PrintFunc, dwarf *gort.DwarfRT, size int, opts ...Option) (*Pool, error) {
+	if size <= 0 {
+		size = runtime.GOMAXPROCS(0)
+	}
+
+	p := &Pool{root: root, print: print, dwarf: newSymbols(dwarf), opts: opts, idle: make(chan *poolState, size)}
+	for i := 0; i < size; i++ {
+		p.idle <- nil
+	}
+	return p, nil
+}
+
+// Execute waits for an idle state until ctx is done, then runs the script like ExecuteContext
+func (p *Pool) Execute(ctx context.Context, script string, session int) error {
+	_, err := p.execute(ctx, script, session, p.print, false)
+	return err
+}
+
+// ExecuteWithResult is ExecuteWithResult on a state of the pool
+func (p *Pool) ExecuteWithResult(ctx context.Context, script string, session int) ([]interface{}, error) {
+	return p.execute(ctx, script, session, p.print, true)
+}
+
+func (p *Pool) execute(ctx context.Context, script string, session int, print PrintFunc, result bool) ([]interface{}, error) {
+	ps, err := p.acquire(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	defer p.release(ps)
+
+	lookupContext(ps.state).print = print
+	rets, err := execute(ctx, ps.state, script, session)
+	if err != nil || !result {
+		return nil, err
+	}
+	// tables are converted before the state is reused
+	return scriptResults(ctx, ps.state, rets, session)
+}
+
+func (p *Pool) acquire(ctx context.Context, session int) (*poolState, error) {
+	if p.isClosed() {
+		return nil, ErrPoolClosed
+	}
+
+	var ps *poolState
+	select {
+	case ps = <-p.idle:
+	case <-ctx.Done():
+		return nil, &TimeoutError{Session: session, Err: ctx.Err()}
+	}
+	if p.isClosed() {
+		p.idle <- ps
+		return nil, ErrPoolClosed
+	}
+	if ps != nil {
+		return ps, nil
+	}
+
+	state, err := newLuaState(p.root, p.print, p.dwarf, p.opts...)
+	if err == nil {
+		// the module is loaded before the snapshot, so it is not loaded again for every session
+		err = state.DoString(`require("` + moduleName + `")`)
+	}
+	if err != nil {
+		if state != nil {
+			state.Close()
+		}
+		p.idle <- nil
+		return nil, err
+	}
+	return &poolState{state: state, snapshot: snapshotState(state)}, nil
+}
+
+func (p *Pool) release(ps *poolState) {
+	ps.state.SetTop(0)
+	ps.snapshot.restore(ps.state)
+	lookupContext(ps.state).print = p.print
+	p.idle <- ps
+}
+
+func (p *Pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// Close waits for running scripts and closes all states
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	for i := 0; i < cap(p.idle); i++ {
+		if ps := <-p.idle; ps != nil {
+			ps.state.Close()
+		}
+	}
+}
+
+// stateSnapshot records the fields of _G, the global tables, package.loaded and the value metatable.
+// tables deeper than that, e.g. fields of go values, are not restored
+type stateSnapshot map[*lua.LTable]*tableSnapshot
+
+type tableSnapshot struct {
+	fields map[lua.LValue]lua.LValue
+	meta   lua.LValue
+}
+
+func snapshotState(state *lua.LState) stateSnapshot {
+	snap := make(stateSnapshot)
+	global := state.G.Global
+	snap.add(state, global)
+	global.ForEach(func(_ lua.LValue, v lua.LValue) {
+		if tb, ok := v.(*lua.LTable); ok {
+			snap.add(state, tb)
+		}
+	})
+	if loaded, ok := state.GetField(state.GetField(global, "package"), "loaded").(*lua.LTable); ok {
+		snap.add(state, loaded)
+		loaded.ForEach(func(_ lua.LValue, v lua.LValue) {
+			if tb, ok := v.(*lua.LTable); ok {
+				snap.add(state, tb)
+			}
+		})
+	}
+	if mt, ok := state.GetTypeMetatable(valueMetaName).(*lua.LTable); ok {
+		snap.add(state, mt)
+	}
+	return snap
+}
+
+func (snap stateSnapshot) add(state *lua.LState, tb *lua.LTable) {
+	if _, ok := snap[tb]; ok {
+		return
+	}
+	ts := &tableSnapshot{fields: make(map[lua.LValue]lua.LValue), meta: state.GetMetatable(tb)}
+	tb.ForEach(func(k lua.LValue, v lua.LValue) {
+		ts.fields[k] = v
+	})
+	snap[tb] = ts
+}
+
+func (snap stateSnapshot) restore(state *lua.LState) {
+	for tb, ts := range snap {
+		var added []lua.LValue
+		tb.ForEach(func(k lua.LValue, _ lua.LValue) {
+			if _, ok := ts.fields[k]; !ok {
+				added = append(added, k)
+			}
+		})
+		for _, k := range added {
+			tb.RawSet(k, lua.LNil)
+		}
+		for k, v := range ts.fields {
+			if tb.RawGet(k) != v {
+				tb.RawSet(k, v)
+			}
+		}
+		if state.GetMetatable(tb) != ts.meta {
+			state.SetMetatable(tb, ts.meta)
+		}
+	}
+}
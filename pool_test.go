@@ -0,0 +1,66 @@
+package go_watch
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPoolReset(t *testing.T) {
+	role := &testRole{ID: 7}
+	out := &testOutput{}
+	pool, err := NewPool(func(name string) interface{} { return role }, out.print, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	// the pool has one state, the second script runs on the state changed by the first
+	ctx := context.Background()
+	if err := pool.Execute(ctx, testScript(`
+		x = 1
+		string.upper = nil
+		package.loaded.foo = {}
+		setmetatable(_G, {__index = function() return 1 end})
+		go_watch.root_get = nil
+		getmetatable(role).__len = nil
+	`), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Execute(ctx, testScript(`
+		assert(rawget(_G, "x") == nil and getmetatable(_G) == nil)
+		assert(string.upper("a") == "A")
+		assert(package.loaded.foo == nil)
+		assert(#role.Items == 0)
+		print(go_watch.get_number(role.ID))
+	`), 2); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "7" {
+		t.Errorf("print = %q, want 7", out.String())
+	}
+}
+
+func TestPoolBusyAndClosed(t *testing.T) {
+	pool, err := NewPool(func(name string) interface{} { return &testRole{} }, func(int, string) {}, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the only state is taken, the script gives up at the deadline
+	ps := <-pool.idle
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	err = pool.Execute(ctx, `print(1)`, 1)
+	cancel()
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || !timeoutErr.Timeout() {
+		t.Errorf("busy pool error = %v, want timeout", err)
+	}
+	pool.idle <- ps
+
+	pool.Close()
+	if err := pool.Execute(context.Background(), `print(1)`, 1); err != ErrPoolClosed {
+		t.Errorf("closed pool error = %v, want %v", err, ErrPoolClosed)
+	}
+}
@@ -0,0 +1,192 @@
+package go_watch
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// searchOptions is the optional table of search_*:
+//
+//	{regex = "^main\\.", glob = "*.(*RoleInfo).*", package = "main", receiver = "*RoleInfo", offset = 0, limit = 20, detail = true}
+type searchOptions struct {
+	include  string
+	regex    *regexp.Regexp
+	glob     string
+	pkg      string
+	receiver string
+	offset   int
+	limit    int
+	detail   bool
+}
+
+func checkSearchOptions(state *lua.LState) *searchOptions {
+	opts := &searchOptions{include: state.OptString(1, "")}
+	tb := state.OptTable(2, nil)
+	if tb == nil {
+		return opts
+	}
+
+	if s, ok := tb.RawGetString("regex").(lua.LString); ok {
+		re, err := regexp.Compile(string(s))
+		if err != nil {
+			state.RaiseError(fmt.Sprintf("regex:%s error:%s", s, err.Error()))
+		}
+		opts.regex = re
+	}
+	if s, ok := tb.RawGetString("glob").(lua.LString); ok {
+		opts.glob = string(s)
+	}
+	if s, ok := tb.RawGetString("package").(lua.LString); ok {
+		opts.pkg = string(s)
+	}
+	if s, ok := tb.RawGetString("receiver").(lua.LString); ok {
+		opts.receiver = strings.TrimSuffix(strings.TrimPrefix(string(s), "("), ")")
+	}
+	if n, ok := tb.RawGetString("offset").(lua.LNumber); ok {
+		opts.offset = int(n)
+	}
+	if n, ok := tb.RawGetString("limit").(lua.LNumber); ok {
+		opts.limit = int(n)
+	}
+	opts.detail = lua.LVAsBool(tb.RawGetString("detail"))
+	return opts
+}
+
+func (opts *searchOptions) match(name string) bool {
+	if opts.include != "" && !strings.Contains(name, opts.include) {
+		return false
+	}
+	if opts.regex != nil && !opts.regex.MatchString(name) {
+		return false
+	}
+	if opts.glob != "" && !globMatch(opts.glob, name) {
+		return false
+	}
+	return true
+}
+
+// matchReceiver follows method sets: "*T" matches methods of T and *T, "T" only methods of T
+func (opts *searchOptions) matchReceiver(fn *funcSymbol) bool {
+	if opts.receiver == "" {
+		return true
+	}
+	if fn.receiver == "" {
+		return false
+	}
+	want := strings.TrimPrefix(opts.receiver, "*")
+	if opts.receiver == want && fn.pointer {
+		return false
+	}
+	// "pkg.T" or "T"
+	if strings.Contains(want, ".") {
+		return want == fn.pkg+"."+fn.receiver
+	}
+	return want == fn.receiver
+}
+
+// funcSymbol is a function name split as pkg.(*receiver).method or pkg.receiver.method
+type funcSymbol struct {
+	name     string
+	pkg      string
+	receiver string
+	pointer  bool
+	method   string
+}
+
+// parseFuncSymbol uses the type index to tell methods `pkg.T.M` from closures `pkg.f.func1`
+func parseFuncSymbol(name string, types *symbolIndex) *funcSymbol {
+	fn := &funcSymbol{name: name, pkg: packageOf(name)}
+	if fn.pkg == "" || len(name) <= len(fn.pkg)+1 {
+		return fn
+	}
+	rest := name[len(fn.pkg)+1:]
+	if strings.HasPrefix(rest, "(*") {
+		end := strings.Index(rest, ").")
+		if end < 0 {
+			return fn
+		}
+		fn.receiver, fn.pointer, fn.method = rest[2:end], true, rest[end+2:]
+		return fn
+	}
+
+	dot := strings.IndexByte(rest, '.')
+	if dot < 0 {
+		return fn
+	}
+	receiver := rest[:dot]
+	// generic receivers are indexed without type arguments
+	typeName := fn.pkg + "." + receiver
+	if i := strings.IndexByte(typeName, '['); i >= 0 {
+		typeName = typeName[:i]
+	}
+	if types != nil && types.Has(typeName) {
+		fn.receiver, fn.method = receiver, rest[dot+1:]
+	}
+	return fn
+}
+
+func (fn *funcSymbol) toTable(state *lua.LState) *lua.LTable {
+	tb := state.NewTable()
+	tb.RawSetString("name", lua.LString(fn.name))
+	tb.RawSetString("package", lua.LString(fn.pkg))
+	if fn.receiver != "" {
+		tb.RawSetString("receiver", lua.LString(fn.receiver))
+		tb.RawSetString("pointer", lua.LBool(fn.pointer))
+		tb.RawSetString("method", lua.LString(fn.method))
+	}
+	return tb
+}
+
+// searchSymbols returns the matched names, or detail tables, and the total count before paging
+func (ctx *Context) searchSymbols(state *lua.LState, export string, idx *symbolIndex, isFunc bool) int {
+	opts := checkSearchOptions(state)
+
+	var types *symbolIndex
+	if isFunc && (opts.detail || opts.receiver != "") {
+		// methods are told apart by the type names, failing to load them only loses receiver info
+		types, _ = ctx.dwarf.Types()
+	}
+
+	names := idx.Names()
+	if opts.pkg != "" {
+		names = idx.Package(opts.pkg)
+	}
+
+	ret := state.NewTable()
+	total := 0
+	for _, name := range names {
+		if !opts.match(name) || !ctx.allowSymbol(export, name) {
+			continue
+		}
+		var fn *funcSymbol
+		if isFunc && (opts.detail || opts.receiver != "") {
+			fn = parseFuncSymbol(name, types)
+			if !opts.matchReceiver(fn) {
+				continue
+			}
+		}
+
+		total++
+		if total <= opts.offset || (opts.limit > 0 && total > opts.offset+opts.limit) {
+			continue
+		}
+		switch {
+		case !opts.detail:
+			ret.Append(lua.LString(name))
+		case fn != nil:
+			ret.Append(fn.toTable(state))
+		default:
+			tb := state.NewTable()
+			tb.RawSetString("name", lua.LString(name))
+			tb.RawSetString("package", lua.LString(packageOf(name)))
+			ret.Append(tb)
+		}
+	}
+
+	state.Push(ret)
+	state.Push(lua.LNumber(total))
+	return 2
+}
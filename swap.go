@@ -0,0 +1,374 @@
+package go_watch
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// globalSwap is a global replaced by global_replace, original is restored by global_restore
+type globalSwap struct {
+	id       int
+	name     string
+	global   reflect.Value
+	original reflect.Value
+
+	mu     sync.Mutex // guards closed, prev and trace
+	closed bool
+	prev   *globalSwap   // swap wrapped by a trace
+	traced reflect.Value // value wrapped by a trace
+	trace  *traceOptions
+
+	stateMu sync.Mutex // serializes calls into state, never held by close
+	state   *lua.LState
+}
+
+// SwapErrorFunc receives the errors of the lua implementations installed by global_replace, name is the replaced global
+type SwapErrorFunc func(session int, name string, err error)
+
+// WithSwapError receives the errors of lua implementations. replaced globals keep being called after the script returns,
+// so fn should outlive the script, without it errors go to the print of the state
+func WithSwapError(fn SwapErrorFunc) Option {
+	return func(ctx *Context) {
+		ctx.swapErr = fn
+	}
+}
+
+// swaps are process wide, a global replaced by one session can be restored by another
+var swaps = struct {
+	sync.Mutex
+	next   int
+	byID   map[int]*globalSwap
+	byName map[string]*globalSwap
+}{byID: make(map[int]*globalSwap), byName: make(map[string]*globalSwap)}
+
+// lGlobalReplace(name, impl) replaces a func or interface global and returns the restore handle.
+// impl is a go value of the global's type, or for func globals a lua function or a source string returning one.
+// lua implementations run in a dedicated state, one call at a time, errors go to WithSwapError and zero values are returned
+func lGlobalReplace(state *lua.LState) int {
+	ctx := getContext(state)
+	name := state.CheckString(1)
+	impl := state.Get(2)
+
+	global := ctx.findGlobal(state, "global_replace", name)
+	sw := &globalSwap{name: name, global: global}
+
+	var fn reflect.Value
+	if ud, ok := impl.(*lua.LUserData); ok {
+		fn = userDataValue(ud)
+		if !fn.IsValid() || !fn.Type().AssignableTo(global.Type()) {
+			state.ArgError(2, fmt.Sprintf("need %s", global.Type().String()))
+		}
+	} else {
+		if global.Kind() != reflect.Func {
+			state.ArgError(2, fmt.Sprintf("global:%s is %s, need a go value", name, global.Type().String()))
+		}
+		if err := ctx.newSwapState(state, sw, impl); err != nil {
+			state.RaiseError(fmt.Sprintf("global:%s %s", name, err.Error()))
+		}
+		fn = reflect.MakeFunc(global.Type(), ctx.swapFunc(sw))
+	}
+
+	state.Push(lua.LNumber(ctx.installSwap(sw, fn, "global_replace", false)))
+	return 1
+}
+
+// installSwap sets the global to fn and registers sw, a traced swap keeps calling the one it wraps
+func (ctx *Context) installSwap(sw *globalSwap, fn reflect.Value, export string, keepPrev bool) int {
+	swaps.Lock()
+	defer swaps.Unlock()
+	prev := swaps.byName[sw.name]
+	if prev != nil {
+		// the first original is kept, restoring goes back to the code the program was built with
+		sw.original = prev.original
+	} else {
+		sw.original = reflect.New(sw.global.Type()).Elem()
+		sw.original.Set(sw.global)
+	}
+
+	audit := ctx.auditWrite(export, sw.global.Type(), sw.name, sw.global)
+	sw.global.Set(fn)
+	audit(sw.global)
+
+	if prev != nil {
+		delete(swaps.byID, prev.id)
+		if keepPrev {
+			sw.prev = prev
+		} else {
+			prev.close()
+		}
+	}
+	swaps.next++
+	sw.id = swaps.next
+	swaps.byID[sw.id] = sw
+	swaps.byName[sw.name] = sw
+	return sw.id
+}
+
+// lGlobalRestore(handle or name) puts the original value back
+func lGlobalRestore(state *lua.LState) int {
+	ctx := getContext(state)
+
+	swaps.Lock()
+	defer swaps.Unlock()
+	var sw *globalSwap
+	switch v := state.Get(1).(type) {
+	case lua.LNumber:
+		sw = swaps.byID[int(v)]
+	case lua.LString:
+		sw = swaps.byName[string(v)]
+	default:
+		state.ArgError(1, "need handle or global name")
+	}
+	if sw == nil {
+		state.RaiseError(fmt.Sprintf("global:%s not replaced", state.Get(1).String()))
+	}
+	ctx.checkSymbol(state, "global_restore", sw.name)
+	if sw.traced.IsValid() {
+		ctx.untraceLocked(sw)
+		return 0
+	}
+
+	audit := ctx.auditWrite("global_restore", sw.global.Type(), sw.name, sw.global)
+	sw.global.Set(sw.original)
+	audit(sw.global)
+
+	delete(swaps.byID, sw.id)
+	delete(swaps.byName, sw.name)
+	sw.close()
+	return 0
+}
+
+// close marks the swap and the wrapped swaps closed, callers still holding the replacement get the original.
+// it does not wait for running calls, the dedicated state is closed once they finish,
+// so a replacement may restore or replace its own global
+func (sw *globalSwap) close() {
+	sw.mu.Lock()
+	sw.closed = true
+	prev := sw.prev
+	sw.prev = nil
+	sw.mu.Unlock()
+
+	if prev != nil {
+		prev.close()
+	}
+	go func() {
+		sw.stateMu.Lock()
+		defer sw.stateMu.Unlock()
+		if sw.state != nil {
+			sw.state.Close()
+			sw.state = nil
+		}
+	}()
+}
+
+func (sw *globalSwap) isClosed() bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.closed
+}
+
+// callValue calls fn with the arguments of a MakeFunc, variadic arguments come as a slice, a nil fn returns zero values
+func callValue(fn reflect.Value, args []reflect.Value) []reflect.Value {
+	if fn.IsNil() {
+		results := make([]reflect.Value, fn.Type().NumOut())
+		for i := range results {
+			results[i] = reflect.Zero(fn.Type().Out(i))
+		}
+		return results
+	}
+	if fn.Type().IsVariadic() {
+		return fn.CallSlice(args)
+	}
+	return fn.Call(args)
+}
+
+// newSwapState creates the state running a lua implementation, with the options of ctx except the executor,
+// calls come from any goroutine and would wait forever on an executor bound to the caller's goroutine
+func (ctx *Context) newSwapState(state *lua.LState, sw *globalSwap, impl lua.LValue) error {
+	opts := append(append([]Option(nil), ctx.opts...), WithExecutor(nil))
+	swapState, err := newLuaState(ctx.root, ctx.print, ctx.dwarf, opts...)
+	if err != nil {
+		return err
+	}
+	lookupContext(swapState).session = ctx.session
+
+	fn, err := moveFunction(state, swapState, sw.name, impl)
+	if err != nil {
+		swapState.Close()
+		return err
+	}
+	swapState.SetTop(0)
+	swapState.Push(fn)
+	sw.state = swapState
+	return nil
+}
+
+// swapEnvTemplate gives the implementation the print and pairs of scripts, and go_watch as a global
+const swapEnvTemplate = `
+		local go_watch = require("go_watch")
+		local session = ...
+` + scriptHelpers + `
+		return setmetatable({print=debug_print, pairs=debug_pairs, go_watch=go_watch}, {__index=_G})
+`
+
+// moveFunction builds impl in to. a source string is run and must return a function,
+// a lua function is rebuilt from its prototype with the upvalues moved
+func moveFunction(from *lua.LState, to *lua.LState, name string, impl lua.LValue) (*lua.LFunction, error) {
+	if err := to.DoString(`require("` + moduleName + `")`); err != nil {
+		return nil, err
+	}
+	envFn, err := to.LoadString(swapEnvTemplate)
+	if err != nil {
+		return nil, err
+	}
+	to.Push(envFn)
+	to.Push(lua.LNumber(lookupContext(to).session))
+	if err := to.PCall(1, 1, nil); err != nil {
+		return nil, err
+	}
+	env := to.CheckTable(-1)
+	to.Pop(1)
+
+	switch v := impl.(type) {
+	case lua.LString:
+		chunk, err := to.Load(strings.NewReader(string(v)), name)
+		if err != nil {
+			return nil, err
+		}
+		chunk.Env = env
+		to.Push(chunk)
+		if err := to.PCall(0, 1, nil); err != nil {
+			return nil, err
+		}
+		fn, ok := to.Get(-1).(*lua.LFunction)
+		to.Pop(1)
+		if !ok {
+			return nil, fmt.Errorf("source need return a function")
+		}
+		return fn, nil
+	case *lua.LFunction:
+		mv := &functionMover{from: from, to: to, env: env, moved: make(map[*lua.LFunction]*lua.LFunction)}
+		return mv.move(v)
+	default:
+		return nil, fmt.Errorf("need go value, lua function or source, got %s", impl.Type().String())
+	}
+}
+
+type functionMover struct {
+	from  *lua.LState
+	to    *lua.LState
+	env   *lua.LTable
+	moved map[*lua.LFunction]*lua.LFunction
+}
+
+// move copies upvalues that do not belong to a state: nil, booleans, numbers, strings, go values,
+// the go_watch module and other lua functions. globals of the script are not visible to the copy
+func (mv *functionMover) move(fn *lua.LFunction) (*lua.LFunction, error) {
+	if m, ok := mv.moved[fn]; ok {
+		return m, nil
+	}
+	if fn.IsG {
+		return nil, fmt.Errorf("go function can not be moved")
+	}
+
+	m := mv.to.NewFunctionFromProto(fn.Proto)
+	m.Env = mv.env
+	mv.moved[fn] = m
+
+	module := mv.from.GetField(mv.from.GetField(mv.from.GetGlobal("package"), "loaded"), moduleName)
+	for i, uv := range fn.Upvalues {
+		var value lua.LValue = lua.LNil
+		if uv != nil {
+			value = uv.Value()
+		}
+
+		switch v := value.(type) {
+		case *lua.LNilType, lua.LBool, lua.LNumber, lua.LString:
+		case *lua.LUserData:
+			value = newUserData(mv.to, v.Value)
+		case *lua.LFunction:
+			f, err := mv.move(v)
+			if err != nil {
+				return nil, err
+			}
+			value = f
+		case *lua.LTable:
+			if v != module {
+				return nil, fmt.Errorf("upvalue %s is a table, use go_watch.global_replace with source instead", upvalueName(fn, i))
+			}
+			value = mv.to.GetField(mv.to.GetField(mv.to.GetGlobal("package"), "loaded"), moduleName)
+		default:
+			return nil, fmt.Errorf("upvalue %s is %s and can not be moved", upvalueName(fn, i), value.Type().String())
+		}
+
+		m.Upvalues[i] = &lua.Upvalue{}
+		m.Upvalues[i].SetValue(value)
+	}
+	return m, nil
+}
+
+func upvalueName(fn *lua.LFunction, i int) string {
+	if i < len(fn.Proto.DbgUpvalues) {
+		return fn.Proto.DbgUpvalues[i]
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+// swapFunc calls the lua implementation with the arguments as go values and converts the results to the func's result types
+func (ctx *Context) swapFunc(sw *globalSwap) func(args []reflect.Value) []reflect.Value {
+	ftyp := sw.global.Type()
+	swapErr := ctx.swapErr
+	if swapErr == nil {
+		print := ctx.print
+		swapErr = func(session int, name string, err error) {
+			print(session, fmt.Sprintf("global:%s replacement error:%s", name, err.Error()))
+		}
+	}
+	session := ctx.session
+
+	zero := func() []reflect.Value {
+		return callValue(reflect.Zero(ftyp), nil)
+	}
+
+	return func(args []reflect.Value) []reflect.Value {
+		if sw.isClosed() {
+			return callValue(sw.original, args)
+		}
+
+		sw.stateMu.Lock()
+		defer sw.stateMu.Unlock()
+		state := sw.state
+		if state == nil {
+			return callValue(sw.original, args)
+		}
+		defer state.SetTop(1)
+		state.Push(state.Get(1))
+		for _, arg := range args {
+			state.Push(newUserData(state, arg))
+		}
+		if err := state.PCall(len(args), ftyp.NumOut(), nil); err != nil {
+			msg := err.Error()
+			if apiErr, ok := err.(*lua.ApiError); ok {
+				msg = apiErr.Object.String()
+			}
+			swapErr(session, sw.name, errors.New(msg))
+			return zero()
+		}
+
+		results := make([]reflect.Value, ftyp.NumOut())
+		for i := range results {
+			rv, err := luaToValue(state.Get(2+i), ftyp.Out(i))
+			if err != nil {
+				swapErr(session, sw.name, fmt.Errorf("result:%d %s", i+1, err.Error()))
+				return zero()
+			}
+			results[i] = rv
+		}
+		return results
+	}
+}
@@ -0,0 +1,46 @@
+package go_watch
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestSwapError(t *testing.T) {
+	var name string
+	var swapErr error
+	state, out := newTestState(t, &testRole{}, WithSwapError(func(session int, global string, err error) {
+		name, swapErr = global, err
+	}))
+	ctx := lookupContext(state)
+
+	var fn func(int) int
+	tests := []struct {
+		impl string
+		err  string
+	}{
+		{`return function(n) error("boom") end`, "boom"},
+		{`return function(n) return "a" end`, "result:1"},
+	}
+	for _, tt := range tests {
+		name, swapErr = "", nil
+		sw := &globalSwap{name: "app.fn", global: reflect.ValueOf(&fn).Elem()}
+		if err := ctx.newSwapState(state, sw, lua.LString(tt.impl)); err != nil {
+			t.Fatal(err)
+		}
+		results := ctx.swapFunc(sw)([]reflect.Value{reflect.ValueOf(1)})
+		sw.state.Close()
+		if len(results) != 1 || results[0].Int() != 0 {
+			t.Errorf("%s: results = %v, want zero", tt.impl, results)
+		}
+		if name != "app.fn" || swapErr == nil || !strings.Contains(swapErr.Error(), tt.err) {
+			t.Errorf("%s: error of %q = %v, want %s", tt.impl, name, swapErr, tt.err)
+		}
+	}
+	// the print of the script is not used, it ends with the script
+	if out.String() != "" {
+		t.Errorf("print = %q, want nothing", out.String())
+	}
+}
@@ -0,0 +1,278 @@
+package go_watch
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lsg2020/gort"
+)
+
+// defaultSymbols is the debug info of the current executable, loaded on first use
+var defaultSymbols = &symbols{}
+
+// symbols loads gort.DwarfRT lazily and serializes access to it, DwarfRT fills its caches lazily and is not safe for concurrent use.
+// states of a Pool or the http handler share one symbols
+type symbols struct {
+	loadOnce sync.Once
+	loadErr  error
+
+	mu    sync.Mutex
+	dwarf *gort.DwarfRT
+
+	funcsOnce   sync.Once
+	funcs       *symbolIndex
+	funcsErr    error
+	globalsOnce sync.Once
+	globals     *symbolIndex
+	globalsErr  error
+	typesOnce   sync.Once
+	types       *symbolIndex
+	typesErr    error
+}
+
+func newSymbols(dwarf *gort.DwarfRT) *symbols {
+	if dwarf == nil {
+		return defaultSymbols
+	}
+	return &symbols{dwarf: dwarf}
+}
+
+func (s *symbols) load() (*gort.DwarfRT, error) {
+	s.loadOnce.Do(func() {
+		if s.dwarf == nil {
+			s.dwarf, s.loadErr = gort.NewDwarfRT("")
+		}
+	})
+	return s.dwarf, s.loadErr
+}
+
+func (s *symbols) FindType(name string) (reflect.Type, error) {
+	dwarf, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return dwarf.FindType(name)
+}
+
+func (s *symbols) FindGlobal(name string) (reflect.Value, error) {
+	dwarf, err := s.load()
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return dwarf.FindGlobal(name)
+}
+
+func (s *symbols) FindFuncType(name string, variadic bool) (reflect.Type, error) {
+	dwarf, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return dwarf.FindFuncType(name, variadic)
+}
+
+// FindFuncEntry returns the code range and the type of a function, methods take the receiver as first argument
+func (s *symbols) FindFuncEntry(name string) (entry uintptr, end uintptr, ftyp reflect.Type, err error) {
+	dwarf, err := s.load()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn, err := dwarf.FindFuncEntry(name)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if ftyp, err = dwarf.FindFuncType(name, false); err != nil {
+		return 0, 0, nil, err
+	}
+	return uintptr(fn.Entry), uintptr(fn.End), ftyp, nil
+}
+
+// CallFunc only holds the lock while looking up the function, so long calls do not block other states
+func (s *symbols) CallFunc(name string, variadic bool, args []reflect.Value) ([]reflect.Value, error) {
+	dwarf, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	fn, err := dwarf.FindFunc(name, variadic)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFuncArgs(fn.Type(), args); err != nil {
+		return nil, err
+	}
+	return fn.Call(args), nil
+}
+
+// checkFuncArgs is the check of gort.DwarfRT.CallFunc, so bad arguments are errors instead of reflect panics
+func checkFuncArgs(ftyp reflect.Type, args []reflect.Value) error {
+	numIn := ftyp.NumIn()
+	if ftyp.IsVariadic() {
+		if len(args) < numIn-1 {
+			return fmt.Errorf("len mismatch %d need at least %d", len(args), numIn-1)
+		}
+	} else if len(args) != numIn {
+		return fmt.Errorf("len mismatch %d need %d", len(args), numIn)
+	}
+
+	for i, arg := range args {
+		var in reflect.Type
+		if ftyp.IsVariadic() && i >= numIn-1 {
+			in = ftyp.In(numIn - 1).Elem()
+		} else {
+			in = ftyp.In(i)
+		}
+		if !arg.IsValid() || !arg.Type().AssignableTo(in) {
+			return fmt.Errorf("type mismatch %d:%s need %s", i, typeString(valueType(arg)), in.String())
+		}
+	}
+	return nil
+}
+
+func valueType(v reflect.Value) reflect.Type {
+	if !v.IsValid() {
+		return nil
+	}
+	return v.Type()
+}
+
+// Funcs returns the index of function names, built on first use
+func (s *symbols) Funcs() (*symbolIndex, error) {
+	s.funcsOnce.Do(func() {
+		s.funcs, s.funcsErr = s.buildIndex(func(dwarf *gort.DwarfRT, add func(string)) error {
+			return dwarf.ForeachFunc(func(name string, pc uint64) { add(name) })
+		})
+	})
+	return s.funcs, s.funcsErr
+}
+
+// Globals returns the index of global variable names, built on first use
+func (s *symbols) Globals() (*symbolIndex, error) {
+	s.globalsOnce.Do(func() {
+		s.globals, s.globalsErr = s.buildIndex(func(dwarf *gort.DwarfRT, add func(string)) error {
+			return dwarf.ForeachGlobal(func(name string, v reflect.Value) { add(name) })
+		})
+	})
+	return s.globals, s.globalsErr
+}
+
+// Types returns the index of type names, built on first use
+func (s *symbols) Types() (*symbolIndex, error) {
+	s.typesOnce.Do(func() {
+		s.types, s.typesErr = s.buildIndex(func(dwarf *gort.DwarfRT, add func(string)) error {
+			return dwarf.ForeachType(add)
+		})
+	})
+	return s.types, s.typesErr
+}
+
+func (s *symbols) buildIndex(foreach func(dwarf *gort.DwarfRT, add func(string)) error) (*symbolIndex, error) {
+	dwarf, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	s.mu.Lock()
+	err = foreach(dwarf, func(name string) {
+		names = append(names, name)
+	})
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return newSymbolIndex(names), nil
+}
+
+// symbolIndex is a sorted name list and the names of every package
+type symbolIndex struct {
+	names    []string
+	packages map[string][]string
+}
+
+func newSymbolIndex(names []string) *symbolIndex {
+	sort.Strings(names)
+	idx := &symbolIndex{packages: make(map[string][]string)}
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+		idx.names = append(idx.names, name)
+		pkg := packageOf(name)
+		idx.packages[pkg] = append(idx.packages[pkg], name)
+	}
+	return idx
+}
+
+// Names returns all names in order, the slice must not be modified
+func (idx *symbolIndex) Names() []string {
+	return idx.names
+}
+
+// Has reports whether name is in the index
+func (idx *symbolIndex) Has(name string) bool {
+	i := sort.SearchStrings(idx.names, name)
+	return i < len(idx.names) && idx.names[i] == name
+}
+
+// Prefix returns the names starting with prefix by binary search
+func (idx *symbolIndex) Prefix(prefix string) []string {
+	start := sort.SearchStrings(idx.names, prefix)
+	end := start
+	for end < len(idx.names) && strings.HasPrefix(idx.names[end], prefix) {
+		end++
+	}
+	return idx.names[start:end]
+}
+
+// Package returns the names declared in the package with import path pkg
+func (idx *symbolIndex) Package(pkg string) []string {
+	return idx.packages[pkg]
+}
+
+// packageOf returns the import path of a symbol name:
+//
+//	github.com/a/b.(*T).M -> github.com/a/b
+//	*map.bucket[string]int -> map
+//	[]main.R -> main
+//
+// names of unnamed types like map[int]*main.R have no package
+func packageOf(name string) string {
+	for {
+		if strings.HasPrefix(name, "*") {
+			name = name[1:]
+		} else if strings.HasPrefix(name, "[") {
+			end := strings.IndexByte(name, ']')
+			if end < 0 {
+				return ""
+			}
+			name = name[end+1:]
+		} else {
+			break
+		}
+	}
+	if strings.HasPrefix(name, "map[") || strings.HasPrefix(name, "func(") || strings.HasPrefix(name, "chan ") ||
+		strings.HasPrefix(name, "struct {") || strings.HasPrefix(name, "interface {") {
+		return ""
+	}
+	// type parameters and receivers may contain other import paths
+	if i := strings.IndexAny(name, "[("); i >= 0 {
+		name = name[:i]
+	}
+	start := strings.LastIndexByte(name, '/') + 1
+	dot := strings.IndexByte(name[start:], '.')
+	if dot < 0 {
+		return ""
+	}
+	return name[:start+dot]
+}
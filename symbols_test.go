@@ -0,0 +1,106 @@
+package go_watch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPackageOf(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"main.main", "main"},
+		{"main.(*R).Add", "main"},
+		{"main.R.Get", "main"},
+		{"main.main.func1", "main"},
+		{"github.com/a/b.(*T).M", "github.com/a/b"},
+		{"github.com/a/b.T", "github.com/a/b"},
+		// dots in the last element of import paths are escaped in symbol names
+		{"gopkg.in/yaml%2ev3.Node", "gopkg.in/yaml%2ev3"},
+		{"*main.R", "main"},
+		{"**main.R", "main"},
+		{"[]main.R", "main"},
+		{"[4]*main.R", "main"},
+		{"*map.bucket[string]int", "map"},
+		{"main.List[go.shape.int]", "main"},
+		{"main.(*List[...]).Push", "main"},
+		{"github.com/a/b.F[github.com/c/d.T]", "github.com/a/b"},
+		{"map[int]*main.R", ""},
+		{"func(int) string", ""},
+		{"chan int", ""},
+		{"struct { a int }", ""},
+		{"interface {}", ""},
+		{"int", ""},
+		{"[]int", ""},
+		{"[", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := packageOf(tt.name); got != tt.want {
+			t.Errorf("packageOf(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSymbolIndex(t *testing.T) {
+	idx := newSymbolIndex([]string{
+		"main.b", "main.a", "os.Args", "main.a", "main.(*R).Add", "github.com/a/b.X", "main.ab",
+	})
+
+	if want := []string{"github.com/a/b.X", "main.(*R).Add", "main.a", "main.ab", "main.b", "os.Args"}; !reflect.DeepEqual(idx.Names(), want) {
+		t.Errorf("Names() = %v, want %v", idx.Names(), want)
+	}
+
+	hasTests := []struct {
+		name string
+		want bool
+	}{
+		{"main.a", true},
+		{"main.ab", true},
+		{"os.Args", true},
+		{"main.", false},
+		{"main.c", false},
+		{"", false},
+		{"zzz", false},
+	}
+	for _, tt := range hasTests {
+		if got := idx.Has(tt.name); got != tt.want {
+			t.Errorf("Has(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	prefixTests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"main.a", []string{"main.a", "main.ab"}},
+		{"main.", []string{"main.(*R).Add", "main.a", "main.ab", "main.b"}},
+		{"main.(*R).", []string{"main.(*R).Add"}},
+		{"os.Args", []string{"os.Args"}},
+		{"net.", []string{}},
+		{"zzz", []string{}},
+		{"", idx.Names()},
+	}
+	for _, tt := range prefixTests {
+		if got := idx.Prefix(tt.prefix); !reflect.DeepEqual(append([]string{}, got...), tt.want) {
+			t.Errorf("Prefix(%q) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+
+	packageTests := []struct {
+		pkg  string
+		want []string
+	}{
+		{"main", []string{"main.(*R).Add", "main.a", "main.ab", "main.b"}},
+		{"github.com/a/b", []string{"github.com/a/b.X"}},
+		{"os", []string{"os.Args"}},
+		{"net", nil},
+	}
+	for _, tt := range packageTests {
+		if got := idx.Package(tt.pkg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Package(%q) = %v, want %v", tt.pkg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package go_watch
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const defaultTraceCount = 100
+
+// TraceRecord is one call recorded by trace_func, Args and Results are %#v of the values
+type TraceRecord struct {
+	Session int
+	Func    string // name of the traced func variable
+	Seq     int    // 1 for the first recorded call
+	Args    string
+	Results string
+	Cost    time.Duration
+}
+
+func (r *TraceRecord) String() string {
+	return fmt.Sprintf("trace %s #%d %s -> %s cost:%s", r.Func, r.Seq, r.Args, r.Results, r.Cost)
+}
+
+type TraceFunc func(record *TraceRecord)
+
+// WithTrace receives the records of trace_func. traced calls keep coming after the script returns,
+// so trace should outlive the script, without it records go to the print of the state
+func WithTrace(trace TraceFunc) Option {
+	return func(ctx *Context) {
+		ctx.trace = trace
+	}
+}
+
+// traceOptions is the optional table of trace_func: {count = 100, duration = 60}, duration in seconds.
+// tracing stops at whichever comes first, count <= 0 means no limit
+type traceOptions struct {
+	count    int
+	duration time.Duration
+	calls    int
+	start    time.Time
+}
+
+// lTraceFunc(name, opts) records every call of a func variable or a function with arguments, results and cost,
+// and returns the handle for global_restore. func variables are wrapped like global_replace does,
+// functions and methods like pkg.(*RoleInfo).setName get a jump to the wrapper at their entry, see patchEntry
+func lTraceFunc(state *lua.LState) int {
+	ctx := getContext(state)
+	name := state.CheckString(1)
+	opts := &traceOptions{count: defaultTraceCount, start: time.Now()}
+	if tb := state.OptTable(2, nil); tb != nil {
+		if n, ok := tb.RawGetString("count").(lua.LNumber); ok {
+			opts.count = int(n)
+		}
+		if n, ok := tb.RawGetString("duration").(lua.LNumber); ok {
+			opts.duration = time.Duration(float64(n) * float64(time.Second))
+		}
+	}
+
+	ctx.checkSymbol(state, "trace_func", name)
+	global, err := ctx.dwarf.FindGlobal(name)
+	if err != nil || !global.IsValid() {
+		if funcs, err := ctx.dwarf.Funcs(); err != nil || !funcs.Has(name) {
+			state.RaiseError(fmt.Sprintf("global:%s not found", name))
+		}
+		global = ctx.patchFunc(state, name)
+	}
+	if global.Kind() != reflect.Func || !global.CanSet() {
+		state.RaiseError(fmt.Sprintf("global:%s is %s, need a func variable", name, global.Type().String()))
+	}
+
+	traced := reflect.New(global.Type()).Elem()
+	traced.Set(global)
+	sw := &globalSwap{name: name, global: global, traced: traced, trace: opts}
+	fn := reflect.MakeFunc(global.Type(), ctx.traceFunc(sw))
+	id := ctx.installSwap(sw, fn, "trace_func", true)
+	if opts.duration > 0 {
+		time.AfterFunc(opts.duration, func() { ctx.untrace(sw) })
+	}
+
+	state.Push(lua.LNumber(id))
+	return 1
+}
+
+// patchFunc returns the func variable called at the entry of a function, it is traced like the func variables of packages
+func (ctx *Context) patchFunc(state *lua.LState, name string) reflect.Value {
+	// the wrapper runs the standard library and go-watch, tracing them would call the wrapper again
+	pkg := packageOf(name)
+	if pkg == "" || skipInstancePackage(pkg) || (pkg != "main" && !underPackage(pkg, mainModule) && stdPackage(pkg)) {
+		state.RaiseError(fmt.Sprintf("func:%s can not be traced, functions of the standard library and go-watch are not supported", name))
+	}
+	if strings.Contains(name, "[") {
+		state.RaiseError(fmt.Sprintf("func:%s can not be traced, generic functions are not supported", name))
+	}
+	entry, end, ftyp, err := ctx.dwarf.FindFuncEntry(name)
+	if err != nil {
+		state.RaiseError(fmt.Sprintf("func:%s %s", name, err.Error()))
+	}
+	target, err := patchEntry(entry, end, ftyp)
+	if err != nil {
+		state.RaiseError(fmt.Sprintf("func:%s can not be traced, %s", name, err.Error()))
+	}
+	return target
+}
+
+func (ctx *Context) traceFunc(sw *globalSwap) func(args []reflect.Value) []reflect.Value {
+	trace := ctx.trace
+	if trace == nil {
+		print := ctx.print
+		trace = func(record *TraceRecord) {
+			print(record.Session, record.String())
+		}
+	}
+	session := ctx.session
+
+	return func(args []reflect.Value) []reflect.Value {
+		if sw.isClosed() {
+			return callValue(sw.traced, args)
+		}
+
+		start := time.Now()
+		results := callValue(sw.traced, args)
+		cost := time.Since(start)
+
+		sw.mu.Lock()
+		opts := sw.trace
+		record := !sw.closed && (opts.count <= 0 || opts.calls < opts.count) &&
+			(opts.duration <= 0 || time.Since(opts.start) < opts.duration)
+		if record {
+			opts.calls++
+		}
+		calls := opts.calls
+		sw.mu.Unlock()
+
+		if record {
+			trace(&TraceRecord{Session: session, Func: sw.name, Seq: calls, Args: formatArgs(args), Results: formatArgs(results), Cost: cost})
+		}
+		if !record || (opts.count > 0 && calls >= opts.count) {
+			ctx.untrace(sw)
+		}
+		return results
+	}
+}
+
+// untrace puts the traced value back unless the global was replaced again since
+func (ctx *Context) untrace(sw *globalSwap) {
+	swaps.Lock()
+	defer swaps.Unlock()
+	ctx.untraceLocked(sw)
+}
+
+func (ctx *Context) untraceLocked(sw *globalSwap) {
+	if swaps.byID[sw.id] != sw {
+		return
+	}
+	audit := ctx.auditWrite("trace_func", sw.global.Type(), sw.name, sw.global)
+	sw.global.Set(sw.traced)
+	audit(sw.global)
+
+	delete(swaps.byID, sw.id)
+	delete(swaps.byName, sw.name)
+	sw.mu.Lock()
+	prev := sw.prev
+	sw.prev = nil
+	sw.mu.Unlock()
+	if prev != nil {
+		swaps.byID[prev.id] = prev
+		swaps.byName[prev.name] = prev
+	}
+	sw.close()
+}
@@ -0,0 +1,110 @@
+package go_watch
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// lTypeInfo(t) describes a type, t is a type name, a Type or a value
+//
+//	{name, string, package, kind, size, align, fields = {{name, type, offset, tag, exported, embedded}},
+//	 elem, key, len, methods = {{name, func, pointer, exported}}}
+func lTypeInfo(state *lua.LState) int {
+	ctx := getContext(state)
+
+	var t reflect.Type
+	switch v := state.Get(1).(type) {
+	case lua.LString:
+		ctx.checkSymbol(state, "type_info", string(v))
+		var err error
+		if t, err = ctx.dwarf.FindType(string(v)); err != nil {
+			state.RaiseError(fmt.Sprintf("type:%s not found", string(v)))
+		}
+	case *lua.LUserData:
+		if typ, ok := v.Value.(reflect.Type); ok {
+			t = typ
+		} else if rv := userDataValue(v); rv.IsValid() {
+			t = rv.Type()
+		}
+	}
+	if t == nil {
+		state.ArgError(1, "need type name, type or value")
+	}
+
+	info := state.NewTable()
+	info.RawSetString("name", lua.LString(t.Name()))
+	info.RawSetString("string", lua.LString(t.String()))
+	info.RawSetString("package", lua.LString(t.PkgPath()))
+	info.RawSetString("kind", lua.LString(t.Kind().String()))
+	info.RawSetString("size", lua.LNumber(t.Size()))
+	info.RawSetString("align", lua.LNumber(t.Align()))
+
+	switch t.Kind() {
+	case reflect.Struct:
+		fields := state.NewTable()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			field := state.NewTable()
+			field.RawSetString("name", lua.LString(f.Name))
+			field.RawSetString("type", lua.LString(f.Type.String()))
+			field.RawSetString("offset", lua.LNumber(f.Offset))
+			field.RawSetString("tag", lua.LString(f.Tag))
+			field.RawSetString("exported", lua.LBool(f.PkgPath == ""))
+			field.RawSetString("embedded", lua.LBool(f.Anonymous))
+			fields.Append(field)
+		}
+		info.RawSetString("fields", fields)
+	case reflect.Map:
+		info.RawSetString("key", lua.LString(t.Key().String()))
+		info.RawSetString("elem", lua.LString(t.Elem().String()))
+	case reflect.Array:
+		info.RawSetString("len", lua.LNumber(t.Len()))
+		info.RawSetString("elem", lua.LString(t.Elem().String()))
+	case reflect.Ptr, reflect.Slice, reflect.Chan:
+		info.RawSetString("elem", lua.LString(t.Elem().String()))
+	}
+
+	info.RawSetString("methods", ctx.typeMethods(state, t))
+	state.Push(info)
+	return 1
+}
+
+// typeMethods finds methods in the function names `pkg.T.M` and `pkg.(*T).M`, unexported and unused methods included.
+// methods of *T are listed for T as well with pointer = true
+func (ctx *Context) typeMethods(state *lua.LState, t reflect.Type) *lua.LTable {
+	methods := state.NewTable()
+	if t.Name() == "" && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Name() == "" || t.PkgPath() == "" {
+		return methods
+	}
+	funcs, err := ctx.dwarf.Funcs()
+	if err != nil {
+		return methods
+	}
+
+	typeName := t.PkgPath() + "." + t.Name()
+	for _, recv := range []struct {
+		prefix  string
+		pointer bool
+	}{{typeName + ".", false}, {t.PkgPath() + ".(*" + t.Name() + ").", true}} {
+		for _, name := range funcs.Prefix(recv.prefix) {
+			method := name[len(recv.prefix):]
+			// closures inside methods are named pkg.T.M.func1
+			if strings.ContainsAny(method, ".[") {
+				continue
+			}
+			m := state.NewTable()
+			m.RawSetString("name", lua.LString(method))
+			m.RawSetString("func", lua.LString(name))
+			m.RawSetString("pointer", lua.LBool(recv.pointer))
+			m.RawSetString("exported", lua.LBool(method[0] >= 'A' && method[0] <= 'Z'))
+			methods.Append(m)
+		}
+	}
+	return methods
+}